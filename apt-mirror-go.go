@@ -2,17 +2,17 @@
 package main
 
 import (
-	"compress/gzip"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/Patrolavia/ratelimit"
 )
@@ -55,15 +55,50 @@ func main() {
 		bucket = ratelimit.NewFromRate(float64(rate*1024), int64(rate*1024), 0)
 	}
 
+	for _, fn := range append(strings.Fields(cfg.Variables["auth_conf"]), cfg.Variables["netrc"]) {
+		if err := cfg.Credentials.Load(fn); err != nil {
+			log.Fatalf("Cannot read credentials from %s: %s", fn, err)
+		}
+	}
+
+	client, err := NewHTTPClient(cfg)
+	if err != nil {
+		log.Fatalf("Cannot create http client: %s", err)
+	}
+	if cfg.GetInt("no_check_certificate") == 1 {
+		log.Printf("Certificates of https servers are not verified")
+	}
+
 	dlMgr := NewManager(
 		func(u *url.URL) string {
 			return fmt.Sprintf("URL scheme %s of %s is not supported", u.Scheme, u)
 		},
 		bucket,
-		http.DefaultClient,
+		client,
+		cfg.Credentials,
 		nthreads,
 	)
 
+	cacheFile := path.Join(cfg.Variables["var_path"], "checksums")
+	switch v := cfg.Variables["verify_checksums"]; v {
+	case "size", "full":
+		log.Printf("Verifying package files with policy %s", v)
+	default:
+		log.Printf("Verifying package files with checksums cached in %s", cacheFile)
+		if cfg.checksums, err = LoadChecksumCache(cacheFile); err != nil {
+			log.Printf("Cannot load checksum cache from %s, ignored: %s", cacheFile, err)
+		}
+	}
+
+	validatorFile := path.Join(cfg.Variables["var_path"], "validators")
+	if cfg.validators, err = LoadValidatorCache(validatorFile); err != nil {
+		log.Printf("Cannot load validators from %s, ignored: %s", validatorFile, err)
+	}
+	byHashFile := path.Join(cfg.Variables["var_path"], "byhash")
+	if cfg.byHash, err = LoadByHash(byHashFile); err != nil {
+		log.Fatalf("Cannot load generations of by-hash files from %s: %s", byHashFile, err)
+	}
+
 	log.Printf("Path holding temp files(skel_path): %s", cfg.Variables["skel_path"])
 	log.Printf("Path holding mirrored files(mirror_path): %s", cfg.Variables["mirror_path"])
 	log.Printf("Default architecture: %s", cfg.Variables["defaultarch"])
@@ -78,21 +113,49 @@ func main() {
 
 	// download info files, process packages file and generate file list
 	debs := make(map[string]bool)
-	for _, repo := range cfg.Repositories {
-		repo.DownloadInfoFiles(cfg, dlMgr)
-
-		for _, comp := range repo.Components {
-			pkgFile := cfg.SkelPath(repo.Packages(comp))
-			var f io.ReadCloser
-			f, err := os.Open(pkgFile)
+	// dists urls of refused suites, every repository of them is refused together
+	refused := make(map[string]*url.URL)
+	infoWG := &sync.WaitGroup{}
+	// package files of each mirrored repository, saved for skipping unchanged suites next time
+	fileLists := make([][]*url.URL, len(cfg.Repositories))
+	for idx, repo := range cfg.Repositories {
+		suite := repo.File("dists/" + repo.Version)
+		if _, ok := refused[suite.String()]; ok {
+			log.Printf("Refusing to mirror %s %s %s: suite is refused", repo.URL, repo.Version, repo.Architecture)
+			continue
+		}
+		indices, err := repo.DownloadInfoFiles(cfg, dlMgr, infoWG)
+		if err == errSuiteUnchanged {
+			files, err := repo.LoadFileList(cfg)
 			if err != nil {
-				// maybe file not found, use gzipped file instead
-				pkgFile = cfg.SkelPath(repo.PackagesGZ(comp))
-				f, err = os.Open(pkgFile)
-				if err == nil {
-					f, err = gzip.NewReader(f)
-				}
+				log.Fatalf("Cannot read file list of %s %s: %s", repo.URL, repo.Version, err)
 			}
+			log.Printf("%s %s %s is not changed, skipped", repo.URL, repo.Version, repo.Architecture)
+			for _, f := range files {
+				debs[f] = true
+			}
+			// info files are not downloaded again, keep them when cleaning
+			filepath.Walk(cfg.MirrorPath(repo.File("dists/"+repo.Version)), func(p string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					debs[p] = true
+				}
+				return nil
+			})
+			continue
+		}
+		if err != nil {
+			// do not publish anything of this suite, info files are removed after
+			// background downloads finish
+			log.Printf("Refusing to mirror %s %s: %s", repo.URL, repo.Version, err)
+			refused[suite.String()] = suite
+			continue
+		}
+		fileLists[idx] = make([]*url.URL, 0)
+
+		// parse exactly the files verified by DownloadInfoFiles
+		for _, u := range indices {
+			pkgFile := cfg.SkelPath(u)
+			f, err := OpenIndex(pkgFile)
 			if err != nil {
 				log.Fatalf("Cannot open package file %s: %s", pkgFile, err)
 			}
@@ -105,6 +168,27 @@ func main() {
 			for _, p := range pkgs {
 				m := cfg.MirrorPath(p.URL)
 				debs[m] = true
+				fileLists[idx] = append(fileLists[idx], p.URL)
+				ch <- p
+			}
+		}
+
+		if !repo.Installer(cfg) {
+			continue
+		}
+		for _, comp := range repo.Components {
+			images, link, err := repo.InstallerImages(cfg, comp)
+			if os.IsNotExist(err) {
+				log.Printf("No installer images for %s %s %s, skipped", repo.URL, repo.Version, comp)
+				continue
+			}
+			if err != nil {
+				log.Fatalf("Cannot parse installer images of %s %s %s: %s", repo.URL, repo.Version, comp, err)
+			}
+			debs[cfg.MirrorPath(link)] = true
+			for _, p := range images {
+				debs[cfg.MirrorPath(p.URL)] = true
+				fileLists[idx] = append(fileLists[idx], p.URL)
 				ch <- p
 			}
 		}
@@ -116,14 +200,56 @@ func main() {
 	for i := 0; i < nthreads; i++ {
 		<-finish
 	}
+	infoWG.Wait()
 
-	for c := range cfg.Clean {
-		log.Printf("Cleaning %s", c)
-		clean(c, cfg, debs)
+	for _, suite := range refused {
+		os.RemoveAll(cfg.SkelPath(suite))
+	}
+	for idx, repo := range cfg.Repositories {
+		if _, ok := refused[repo.File("dists/"+repo.Version).String()]; ok {
+			fileLists[idx] = nil
+		}
+	}
+
+	// previous generations of by-hash files are kept for clients reading old Release files
+	for _, p := range cfg.byHash.Prune(cfg.GetInt("byhash_keep"), dryRun) {
+		debs[p] = true
+	}
+
+	if len(refused) > 0 {
+		// package files of refused suites are not in debs, cleaning will remove them.
+		log.Printf("Some suites are refused, skip cleaning")
+	} else {
+		for c := range cfg.Clean {
+			log.Printf("Cleaning %s", c)
+			clean(c, cfg, debs)
+		}
 	}
 
 	if !dryRun {
 		movefiles(cfg.Variables["skel_path"], cfg.Variables["mirror_path"])
+
+		if err := cfg.byHash.Save(byHashFile); err != nil {
+			log.Printf("Cannot save generations of by-hash files to %s: %s", byHashFile, err)
+		}
+
+		for idx, repo := range cfg.Repositories {
+			if fileLists[idx] == nil {
+				continue
+			}
+			if err := repo.SaveFileList(cfg, fileLists[idx]); err != nil {
+				log.Printf("Cannot save file list of %s %s: %s", repo.URL, repo.Version, err)
+				// stale list must not be used
+				os.Remove(repo.fileListPath(cfg))
+			}
+		}
+	}
+
+	if err := cfg.checksums.Save(cacheFile); err != nil {
+		log.Printf("Cannot save checksum cache to %s: %s", cacheFile, err)
+	}
+	if err := cfg.validators.Save(validatorFile); err != nil {
+		log.Printf("Cannot save validators to %s: %s", validatorFile, err)
 	}
 
 }
@@ -175,7 +301,8 @@ func clean(urlStr string, cfg *Config, debs map[string]bool) {
 		log.Fatalf("%s is not a valid url: %s", urlStr, err)
 	}
 
-	mirrorPath := cfg.MirrorPath(u)
+	// paths of files found in it must be same as keys in debs
+	mirrorPath := path.Clean(cfg.MirrorPath(u))
 	doClean(mirrorPath, debs)
 }
 
@@ -228,23 +355,144 @@ func doClean(dir string, debs map[string]bool) {
 	}
 }
 
+// releaseFiles are files published together, after all other files.
+var releaseFiles = []string{"Release", "InRelease", "Release.gpg"}
+
+func isReleaseFile(fn string) bool {
+	base := filepath.Base(fn)
+	for _, r := range releaseFiles {
+		if base == r {
+			return true
+		}
+	}
+	return false
+}
+
+// movefiles moves all files in src into dst.
+//
+// Release files are moved after all other files, so clients never see
+// Release files referring to index files not published yet. Release,
+// InRelease and Release.gpg in same directory are published together,
+// stale ones in dst are removed if not in src.
 func movefiles(src, dst string) {
+	dirs := make(map[string]bool)
+	err := filepath.Walk(src, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(fn, partialSuffix) {
+			// unfinished download is never published
+			return nil
+		}
+		if isReleaseFile(fn) {
+			dirs[filepath.Dir(fn)] = true
+			return nil
+		}
+		return movefile(src, dst, fn)
+	})
+	if err != nil {
+		log.Fatalf("Cannot move files in %s to %s: %s", src, dst, err)
+	}
+
+	for dir := range dirs {
+		for _, r := range releaseFiles {
+			fn := filepath.Join(dir, r)
+			if _, err := os.Stat(fn); err == nil {
+				err = movefile(src, dst, fn)
+			} else {
+				rel, _ := filepath.Rel(src, fn)
+				stale := filepath.Join(dst, rel)
+				if err = os.Remove(stale); err == nil {
+					log.Printf("Remove stale file %s", stale)
+				}
+				if os.IsNotExist(err) {
+					err = nil
+				}
+			}
+			if err != nil {
+				log.Fatalf("Cannot move %s to %s: %s", fn, dst, err)
+			}
+		}
+	}
+
 	f, err := os.Open(src)
 	if err != nil {
 		log.Fatalf("Cannot open dir %s for read: %s", src, err)
 	}
 	defer f.Close()
 
-	dirs, err := f.Readdirnames(-1)
+	children, err := f.Readdirnames(-1)
 	if err != nil {
 		log.Fatalf("Cannot read contents of dir %s for read: %s", src, err)
 	}
+	for _, child := range children {
+		os.RemoveAll(path.Join(src, child))
+	}
+}
+
+// movefile moves file fn in src into same relative path in dst.
+func movefile(src, dst, fn string) error {
+	rel, err := filepath.Rel(src, fn)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(dst, rel)
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err = os.Rename(fn, target); err == nil {
+		return nil
+	}
 
-	for _, dir := range dirs {
-		fn := path.Join(src, dir)
-		if err := exec.Command("cp", "-r", fn, dst).Run(); err != nil {
-			log.Fatalf("Cannot move %s to %s: %s", fn, dst, err)
+	if l, e := os.Readlink(fn); e == nil {
+		// symlink like "current" of installer images, recreate it
+		tmp := target + ".tmp"
+		os.Remove(tmp)
+		if err = os.Symlink(l, tmp); err != nil {
+			return err
+		}
+		if err = os.Rename(tmp, target); err != nil {
+			os.Remove(tmp)
+			return err
 		}
-		exec.Command("rm", "-fr", fn).Run()
+		return os.Remove(fn)
+	}
+
+	// src and dst might be on different filesystems, copy to a temporary file
+	// next to target, and rename it to replace target.
+	tmp := target + ".tmp"
+	if err = copyFile(fn, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(fn)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
 	}
+	return os.Chtimes(dst, stat.ModTime(), stat.ModTime())
 }
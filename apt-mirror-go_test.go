@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMoveFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "skel")
+	dst := path.Join(dir, "mirror")
+	write := func(fn, content string) {
+		os.MkdirAll(path.Dir(fn), 0755)
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatalf("Cannot write %s: %s", fn, err)
+		}
+	}
+
+	suite := "example.com/debian/dists/stable"
+	write(path.Join(src, suite, "Release"), "new")
+	write(path.Join(src, suite, "Release.gpg"), "new")
+	write(path.Join(src, suite, "main/binary-amd64/Packages"), "new")
+	write(path.Join(dst, suite, "Release"), "old")
+	write(path.Join(dst, suite, "InRelease"), "old")
+	write(path.Join(dst, suite, "main/binary-amd64/Packages"), "old")
+	write(path.Join(dst, "example.com/debian/pool/a.deb"), "old")
+
+	movefiles(src, dst)
+
+	expect := map[string]string{
+		"Release":                    "new",
+		"Release.gpg":                "new",
+		"main/binary-amd64/Packages": "new",
+		"../../pool/a.deb":           "old",
+	}
+	for fn, content := range expect {
+		data, err := ioutil.ReadFile(path.Join(dst, suite, fn))
+		if err != nil {
+			t.Errorf("Cannot read %s: %s", fn, err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("Expected content of %s is %s, got %s", fn, content, string(data))
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dst, suite, "InRelease")); !os.IsNotExist(err) {
+		t.Errorf("Expected stale InRelease removed, got %v", err)
+	}
+	if children, _ := ioutil.ReadDir(src); len(children) != 0 {
+		t.Errorf("Expected %s is empty, got %d children", src, len(children))
+	}
+}
+
+func TestCleanLocalRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "archive")
+	for _, c := range []string{"file://" + archive, archive} {
+		cfg := testConfig(t, dir, "deb "+c+" stable main\nclean "+c)
+		repo := cfg.Repositories[0]
+		keep := cfg.MirrorPath(repo.File("pool/main/f/foo/foo_1.0_amd64.deb"))
+		stale := cfg.MirrorPath(repo.File("pool/main/b/bar/bar_1.0_amd64.deb"))
+		for _, fn := range []string{keep, stale} {
+			os.MkdirAll(path.Dir(fn), 0755)
+			ioutil.WriteFile(fn, []byte("deb"), 0644)
+		}
+
+		debs := map[string]bool{keep: true}
+		for u := range cfg.Clean {
+			clean(u, cfg, debs)
+		}
+		if _, err := os.Stat(keep); err != nil {
+			t.Errorf("Expected %s is kept cleaning %s: %s", keep, c, err)
+		}
+		if _, err := os.Stat(stale); !os.IsNotExist(err) {
+			t.Errorf("Expected %s is removed cleaning %s, got %v", stale, c, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Credential is login and password for urls matching Machine.
+//
+// Machine is "host[:port][/path]", optionally prefixed with scheme like
+// "https://", which is same as apt's auth.conf. Like apt, Machine without scheme
+// never matches plain http urls, so credentials are not sent in cleartext unless
+// "http://" is specified explicitly; it matches https, and ftp for netrc. Empty
+// Machine is the "default" entry of netrc, which matches only ftp urls, so it is
+// never sent to every http server or redirect target.
+type Credential struct {
+	Machine  string
+	Login    string
+	Password string
+}
+
+func (c Credential) match(u *url.URL) bool {
+	if c.Machine == "" {
+		return u.Scheme == "ftp"
+	}
+	m := c.Machine
+	if idx := strings.Index(m, "://"); idx >= 0 {
+		if m[:idx] != u.Scheme {
+			return false
+		}
+		m = m[idx+3:]
+	} else if u.Scheme != "https" && u.Scheme != "ftp" {
+		return false
+	}
+	m = strings.TrimSuffix(m, "/")
+
+	target := u.Host + u.Path
+	if !strings.Contains(m, ":") {
+		target = u.Hostname() + u.Path
+	}
+	return target == m || strings.HasPrefix(target, m+"/")
+}
+
+// Credentials finds login and password for urls.
+// Longest matching machine wins, or the one added first if there's a tie.
+type Credentials struct {
+	lock sync.RWMutex
+	list []Credential
+}
+
+// Add adds a credential.
+func (c *Credentials) Add(machine, login, password string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.list = append(c.list, Credential{machine, login, password})
+}
+
+// Find returns login and password of u, ok is false if not found.
+func (c *Credentials) Find(u *url.URL) (login, password string, ok bool) {
+	if c == nil {
+		return
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	best := -1
+	for _, cred := range c.list {
+		if len(cred.Machine) > best && cred.match(u) {
+			best = len(cred.Machine)
+			login, password, ok = cred.Login, cred.Password, true
+		}
+	}
+	return
+}
+
+// Parse parses netrc format used by ~/.netrc and apt's auth.conf:
+//
+//	machine example.com/debian login user password secret
+//	default login anonymous password user@example.com
+func (c *Credentials) Parse(data string) error {
+	tokens := strings.Fields(data)
+	var cur *Credential
+	add := func() {
+		if cur != nil {
+			c.Add(cur.Machine, cur.Login, cur.Password)
+		}
+	}
+	for i := 0; i < len(tokens); i++ {
+		next := func() (string, error) {
+			i++
+			if i >= len(tokens) {
+				return "", fmt.Errorf("missing value of %s", tokens[i-1])
+			}
+			return tokens[i], nil
+		}
+
+		var err error
+		switch tokens[i] {
+		case "machine":
+			add()
+			cur = &Credential{}
+			cur.Machine, err = next()
+		case "default":
+			add()
+			cur = &Credential{}
+		case "login":
+			if cur != nil {
+				cur.Login, err = next()
+			}
+		case "password":
+			if cur != nil {
+				cur.Password, err = next()
+			}
+		case "port", "account":
+			// not used
+			_, err = next()
+		case "macdef":
+			// macro definitions are useless to us, stop parsing here
+			add()
+			return nil
+		default:
+			err = fmt.Errorf("unknown token %s", tokens[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	add()
+	return nil
+}
+
+// Load reads credentials from files. If fn is a directory, every *.conf file in it is read,
+// like /etc/apt/auth.conf.d. Files not exist are ignored.
+func (c *Credentials) Load(fn string) error {
+	stat, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	files := []string{fn}
+	if stat.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(fn, "*.conf")); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if err = c.Parse(string(data)); err != nil {
+			return fmt.Errorf("cannot parse %s: %s", f, err)
+		}
+	}
+	return nil
+}
+
+// authTransport adds basic auth header to requests if the url has credential.
+type authTransport struct {
+	base  http.RoundTripper
+	creds *Credentials
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") == "" {
+		if login, password, ok := t.creds.Find(req.URL); ok {
+			// RoundTripper should not modify the request
+			req = req.Clone(req.Context())
+			req.SetBasicAuth(login, password)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
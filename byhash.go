@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// byHashAlgos are checksum sections of Release file, and also directory names in by-hash.
+var byHashAlgos = []string{"MD5Sum", "SHA1", "SHA256", "SHA512"}
+
+// ByHash tracks generations of files in by-hash directories, so clients reading
+// Release file of previous generations can still get index files while mirror is
+// updating.
+//
+// A nil *ByHash is valid, which tracks nothing.
+type ByHash struct {
+	lock sync.Mutex
+	// history maps by-hash directory in mirror_path to file names of each
+	// generation, newest first.
+	history map[string][][]string
+	// current holds file names of current generation.
+	current map[string]map[string]bool
+}
+
+// LoadByHash reads generations of by-hash files from file. Empty history is returned
+// if the file does not exist.
+func LoadByHash(fn string) (*ByHash, error) {
+	ret := &ByHash{
+		history: make(map[string][][]string),
+		current: make(map[string]map[string]bool),
+	}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// each line is a generation "dir names...", tab separated, newest first
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		data := strings.Split(scanner.Text(), "\t")
+		if len(data) < 2 {
+			return nil, fmt.Errorf("format error at line#%d of %s", lineno, fn)
+		}
+		ret.history[data[0]] = append(ret.history[data[0]], data[1:])
+	}
+	return ret, scanner.Err()
+}
+
+// Save writes generations of by-hash files into file.
+func (b *ByHash) Save(fn string) error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return writeStateFile(fn, func(w io.Writer) {
+		for dir, gens := range b.history {
+			for _, g := range gens {
+				fmt.Fprintf(w, "%s\t%s\n", dir, strings.Join(g, "\t"))
+			}
+		}
+	})
+}
+
+// Link hardlinks downloaded index file u to by-hash directories next to it, one for
+// each checksum listed in Release file.
+func (b *ByHash) Link(cfg *Config, u *url.URL, sums Checksums) error {
+	if b == nil {
+		return nil
+	}
+	for _, algo := range byHashAlgos {
+		sum := sums.get(algo)
+		if sum == "" {
+			continue
+		}
+		dir := *u
+		dir.Path = path.Join(path.Dir(u.Path), "by-hash", algo)
+		target := dir
+		target.Path = path.Join(dir.Path, sum)
+		if err := linkFile(cfg.SkelPath(u), cfg.SkelPath(&target)); err != nil {
+			return err
+		}
+
+		b.lock.Lock()
+		m := cfg.MirrorPath(&dir)
+		if b.current[m] == nil {
+			b.current[m] = make(map[string]bool)
+		}
+		b.current[m][sum] = true
+		b.lock.Unlock()
+	}
+	return nil
+}
+
+// Prune removes files in by-hash directories of mirror_path, which are older than
+// keep generations before current one. Directories not updated in this run are not
+// touched. It returns path of files kept in mirror_path.
+func (b *ByHash) Prune(keep int, dryRun bool) (ret []string) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for dir, cur := range b.current {
+		names := make([]string, 0, len(cur))
+		for n := range cur {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		gens := b.history[dir]
+		if len(gens) == 0 || strings.Join(gens[0], " ") != strings.Join(names, " ") {
+			gens = append([][]string{names}, gens...)
+		}
+		if len(gens) > keep+1 {
+			gens = gens[:keep+1]
+		}
+		b.history[dir] = gens
+
+		kept := make(map[string]bool)
+		for _, g := range gens {
+			for _, n := range g {
+				kept[n] = true
+			}
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			p := dir + "/" + f.Name()
+			if kept[f.Name()] {
+				ret = append(ret, p)
+				continue
+			}
+			log.Printf("Remove out-dated file %s", p)
+			if !dryRun {
+				os.Remove(p)
+			}
+		}
+	}
+	return
+}
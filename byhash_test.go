@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestByHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "archive")
+	cfg := testConfig(t, dir, "deb "+archive+" stable main")
+	repo := cfg.Repositories[0]
+	byHashFile := path.Join(dir, "var", "byhash")
+	byHashDir := cfg.MirrorPath(repo.File("dists/stable/main/binary-amd64/by-hash/SHA256"))
+
+	sums := []string{}
+	for i := 0; i < 4; i++ {
+		pkgs := fmt.Sprintf("Package: foo\nFilename: pool/main/f/foo/foo_1.%d_amd64.deb\nSize: 5\n", i)
+		os.RemoveAll(archive)
+		writeTestArchive(t, archive, "stable", map[string]string{
+			"dists/stable/main/binary-amd64/Packages": pkgs,
+		})
+		rel := path.Join(archive, "dists/stable/Release")
+		data, _ := ioutil.ReadFile(rel)
+		ioutil.WriteFile(rel, append([]byte("Acquire-By-Hash: yes\n"), data...), 0644)
+		sums = append(sums, fmt.Sprintf("%x", sha256.Sum256([]byte(pkgs))))
+
+		if cfg.byHash, err = LoadByHash(byHashFile); err != nil {
+			t.Fatalf("Cannot load by-hash history: %s", err)
+		}
+		wg := &sync.WaitGroup{}
+		if _, err := repo.DownloadInfoFiles(cfg, testManager(), wg); err != nil {
+			t.Fatalf("Cannot download info files: %s", err)
+		}
+		wg.Wait()
+
+		skel := cfg.SkelPath(repo.File("dists/stable/main/binary-amd64/by-hash/SHA256/" + sums[i]))
+		if actual, _ := ioutil.ReadFile(skel); string(actual) != pkgs {
+			t.Errorf("Expected by-hash file %s is linked to Packages, got %#v", skel, string(actual))
+		}
+
+		kept := cfg.byHash.Prune(1, false)
+		movefiles(cfg.Variables["skel_path"], cfg.Variables["mirror_path"])
+		if err := cfg.byHash.Save(byHashFile); err != nil {
+			t.Fatalf("Cannot save by-hash history: %s", err)
+		}
+
+		// current and 1 previous generation
+		expect := map[string]bool{sums[i]: true}
+		if i > 0 {
+			expect[sums[i-1]] = true
+		}
+		files, _ := ioutil.ReadDir(byHashDir)
+		actual := map[string]bool{}
+		for _, f := range files {
+			actual[f.Name()] = true
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(expect) {
+			t.Errorf("Generation #%d: expected by-hash files %v, got %v", i, expect, actual)
+		}
+		// previous generation in MD5Sum and SHA256
+		if i > 0 && len(kept) != 2 {
+			t.Errorf("Generation #%d: expected previous generation is kept for cleaning, got %v", i, kept)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// Checksums holds known hash values of a file in lower-case hex form.
+// Empty string means we don't know that hash value.
+type Checksums struct {
+	MD5    string
+	SHA1   string
+	SHA256 string
+	SHA512 string
+}
+
+// get returns hash value of algo, which is name of checksum section in Release file.
+func (c Checksums) get(algo string) string {
+	switch algo {
+	case "MD5Sum":
+		return c.MD5
+	case "SHA1":
+		return c.SHA1
+	case "SHA256":
+		return c.SHA256
+	case "SHA512":
+		return c.SHA512
+	}
+	return ""
+}
+
+// Strongest returns name and value of the strongest hash we know.
+// Returns empty strings if no hash value is known.
+func (c Checksums) Strongest() (algo, sum string) {
+	switch {
+	case c.SHA512 != "":
+		return "SHA512", c.SHA512
+	case c.SHA256 != "":
+		return "SHA256", c.SHA256
+	case c.SHA1 != "":
+		return "SHA1", c.SHA1
+	case c.MD5 != "":
+		return "MD5Sum", c.MD5
+	}
+	return
+}
+
+func newHash(algo string) hash.Hash {
+	switch algo {
+	case "SHA512":
+		return sha512.New()
+	case "SHA256":
+		return sha256.New()
+	case "SHA1":
+		return sha1.New()
+	case "MD5Sum":
+		return md5.New()
+	}
+	return nil
+}
+
+// VerifyFile checks if the file at path has expected size and content.
+// Content is checked against the strongest known hash, and only size is
+// checked if no hash is known. Size is not checked if negative.
+func VerifyFile(path string, size int64, sums Checksums) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if size >= 0 && stat.Size() != size {
+		return fmt.Errorf("size of %s mismatch: expected %d, got %d", path, size, stat.Size())
+	}
+
+	algo, sum := sums.Strongest()
+	if algo == "" {
+		return nil
+	}
+	actual, err := hashReader(f, algo)
+	if err != nil {
+		return err
+	}
+	if actual != strings.ToLower(sum) {
+		return fmt.Errorf("%s of %s mismatch: expected %s, got %s", algo, path, sum, actual)
+	}
+	return nil
+}
+
+// HashFile computes hash value of the file at path, algo is one of MD5Sum, SHA1, SHA256 and SHA512.
+func HashFile(path, algo string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return hashReader(f, algo)
+}
+
+func hashReader(r io.Reader, algo string) (string, error) {
+	h := newHash(algo)
+	if h == nil {
+		return "", fmt.Errorf("unsupported hash algorithm %s", algo)
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type cacheEntry struct {
+	size  int64
+	mtime int64
+	inode uint64
+	algo  string
+	sum   string
+}
+
+func newCacheEntry(fi os.FileInfo, algo, sum string) cacheEntry {
+	return cacheEntry{fi.Size(), fi.ModTime().UnixNano(), fileInode(fi), algo, sum}
+}
+
+// ChecksumCache remembers checksums of local files, so we don't have to hash
+// a file again if its size, modification time and inode are not changed.
+//
+// A nil *ChecksumCache is valid, which hashes file every time.
+type ChecksumCache struct {
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// LoadChecksumCache reads cached checksums from file. An empty cache is returned
+// if the file does not exist.
+func LoadChecksumCache(fn string) (*ChecksumCache, error) {
+	ret := &ChecksumCache{entries: make(map[string]cacheEntry)}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// each line is "path size mtime inode algo sum", tab separated
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		data := strings.Split(scanner.Text(), "\t")
+		if len(data) != 6 {
+			return nil, fmt.Errorf("format error at line#%d of %s", lineno, fn)
+		}
+		var e cacheEntry
+		var err1, err2, err3 error
+		e.size, err1 = strconv.ParseInt(data[1], 10, 64)
+		e.mtime, err2 = strconv.ParseInt(data[2], 10, 64)
+		e.inode, err3 = strconv.ParseUint(data[3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, fmt.Errorf("format error at line#%d of %s", lineno, fn)
+		}
+		e.algo, e.sum = data[4], data[5]
+		ret.entries[data[0]] = e
+	}
+	return ret, scanner.Err()
+}
+
+// Save writes cached checksums into file. Records of files no longer exist are dropped.
+func (c *ChecksumCache) Save(fn string) error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return writeStateFile(fn, func(w io.Writer) {
+		for p, e := range c.entries {
+			if _, err := os.Lstat(p); err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", p, e.size, e.mtime, e.inode, e.algo, e.sum)
+		}
+	})
+}
+
+// Sum returns hash value of the file at p, fi is the result of os.Stat(p).
+// Cached value is used if the file is not changed.
+func (c *ChecksumCache) Sum(p string, fi os.FileInfo, algo string) (string, error) {
+	if c == nil {
+		return HashFile(p, algo)
+	}
+
+	c.lock.Lock()
+	e, ok := c.entries[p]
+	c.lock.Unlock()
+	if ok && e == newCacheEntry(fi, algo, e.sum) {
+		return e.sum, nil
+	}
+
+	sum, err := HashFile(p, algo)
+	if err != nil {
+		return "", err
+	}
+	c.Remember(p, fi, algo, sum)
+	return sum, nil
+}
+
+// Remember records hash value of the file at p, fi is the result of os.Stat(p).
+func (c *ChecksumCache) Remember(p string, fi os.FileInfo, algo, sum string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[p] = newCacheEntry(fi, algo, sum)
+}
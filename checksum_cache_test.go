@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestChecksumCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := path.Join(dir, "a.deb")
+	cacheFile := path.Join(dir, "var/checksums")
+	hello := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if err := ioutil.WriteFile(fn, []byte("hello"), 0644); err != nil {
+		t.Fatalf("Cannot write test file: %s", err)
+	}
+
+	cache, err := LoadChecksumCache(cacheFile)
+	if err != nil {
+		t.Fatalf("Cannot load empty cache: %s", err)
+	}
+	fi, _ := os.Stat(fn)
+	if sum, err := cache.Sum(fn, fi, "SHA256"); err != nil || sum != hello {
+		t.Fatalf("Expected sha256 %s, got %s, %v", hello, sum, err)
+	}
+	if err := cache.Save(cacheFile); err != nil {
+		t.Fatalf("Cannot save cache: %s", err)
+	}
+
+	cache, err = LoadChecksumCache(cacheFile)
+	if err != nil {
+		t.Fatalf("Cannot load cache: %s", err)
+	}
+
+	// cached value is returned as long as the file looks unchanged
+	mtime := fi.ModTime()
+	ioutil.WriteFile(fn, []byte("hellO"), 0644)
+	os.Chtimes(fn, mtime, mtime)
+	fi, _ = os.Stat(fn)
+	if sum, err := cache.Sum(fn, fi, "SHA256"); err != nil || sum != hello {
+		t.Errorf("Expected cached sha256 %s, got %s, %v", hello, sum, err)
+	}
+
+	// hash it again if modification time changed
+	os.Chtimes(fn, mtime, mtime.Add(time.Second))
+	fi, _ = os.Stat(fn)
+	if sum, err := cache.Sum(fn, fi, "SHA256"); err != nil || sum == hello {
+		t.Errorf("Expected file hashed again, got %s, %v", sum, err)
+	}
+}
+
+func TestPackageTestPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	u, _ := url.Parse("http://example.com/debian/pool/a.deb")
+	p := Package{URL: u, Size: 5, Checksums: Checksums{
+		SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}}
+	cfg := &Config{Variables: map[string]string{
+		"mirror_path": path.Join(dir, "mirror"),
+		"skel_path":   path.Join(dir, "skel"),
+	}}
+	fn := cfg.MirrorPath(u)
+	os.MkdirAll(path.Dir(fn), 0755)
+
+	data := map[string]map[string]bool{
+		"hello": {"size": true, "full": true, "cached": true},
+		"hellO": {"size": true, "full": false, "cached": false},
+		"hell":  {"size": false, "full": false, "cached": false},
+	}
+	for content, expect := range data {
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatalf("Cannot write test file: %s", err)
+		}
+		for policy, result := range expect {
+			cfg.Variables["verify_checksums"] = policy
+			cfg.checksums = &ChecksumCache{entries: make(map[string]cacheEntry)}
+			if actual := p.Test(cfg); actual != result {
+				t.Errorf("Expected %#v with policy %s is %v, got %v", content, policy, result, actual)
+			}
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// there's no inode on windows, size and mtime are all we can check.
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
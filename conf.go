@@ -3,7 +3,9 @@ package main
 import (
 	"log"
 	"net/url"
+	"os"
 	"os/exec"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -31,6 +33,15 @@ type Config struct {
 	Variables    map[string]string
 	Repositories []Repository
 	Clean        map[string]bool
+	// Credentials holds login and password for urls
+	Credentials *Credentials
+
+	// checksums caches checksums of package files on disk
+	checksums *ChecksumCache
+	// validators caches ETag and Last-Modified of info files
+	validators *ValidatorCache
+	// byHash tracks generations of by-hash files
+	byHash *ByHash
 }
 
 /*
@@ -42,17 +53,41 @@ func ParseConfig(cfgString string) (ret *Config, err error) {
 	// setup default values
 	ret = &Config{
 		map[string]string{
-			"defaultarch":       strings.TrimSpace(string(defaultArch)),
-			"base_path":         "/var/spool/apt-mirror",
-			"mirror_path":       "/var/spool/apt-mirror/mirror",
-			"skel_path":         "/var/spool/apt-mirror/skel",
-			"postmirror_script": "",
-			"run_postmirror":    "0",
-			"nthreads":          "20",
-			"translations":      "en",
+			"defaultarch":          strings.TrimSpace(string(defaultArch)),
+			"base_path":            "/var/spool/apt-mirror",
+			"mirror_path":          "/var/spool/apt-mirror/mirror",
+			"skel_path":            "/var/spool/apt-mirror/skel",
+			"var_path":             "/var/spool/apt-mirror/var",
+			"postmirror_script":    "",
+			"run_postmirror":       "0",
+			"nthreads":             "20",
+			"translations":         "en",
+			"dep11_icons":          "48x48 64x64 64x64@2 128x128",
+			"gpg_keyring":          "",
+			"verify_checksums":     "cached",
+			"ca_certificate":       "",
+			"certificate":          "",
+			"private_key":          "",
+			"no_check_certificate": "0",
+			"use_proxy":            "off",
+			"http_proxy":           "",
+			"https_proxy":          "",
+			"proxy_user":           "",
+			"proxy_password":       "",
+			"no_proxy":             "",
+			"auth_conf":            "/etc/apt/auth.conf /etc/apt/auth.conf.d",
+			"netrc":                path.Join(os.Getenv("HOME"), ".netrc"),
+			"byhash_keep":          "2",
+			"use_pdiff":            "0",
+			"mirror_udeb":          "0",
+			"mirror_installer":     "0",
 		},
 		make([]Repository, 0),
 		make(map[string]bool),
+		&Credentials{},
+		nil,
+		nil,
+		nil,
 	}
 	arr := strings.Split(cfgString, "\n")
 	for _, line := range arr {
@@ -97,12 +132,22 @@ func ParseConfig(cfgString string) (ret *Config, err error) {
 					continue
 				}
 				ret.Repositories = append(ret.Repositories, repo)
+				if repo.auth != nil {
+					pass, _ := repo.auth.Password()
+					// with scheme, so it matches plain http repository too
+					ret.Credentials.Add(repo.URL.Scheme+"://"+repo.URL.Host+repo.URL.Path, repo.auth.Username(), pass)
+				}
 			}
 		}
 
 		// specify what directory to clean
 		if line[0:6] == "clean " {
 			val := strings.TrimSpace(line[6:])
+			if u, err := url.Parse(val); err == nil && u.User != nil {
+				// never log credentials
+				u.User = nil
+				val = u.String()
+			}
 			ret.Clean[val] = true
 		}
 
@@ -111,20 +156,25 @@ func ParseConfig(cfgString string) (ret *Config, err error) {
 	return
 }
 
+// localPath returns path of u in base directory. It is cleaned, so urls of local
+// archives without host, like "file:///x", never produce "//" which does not match
+// paths found when cleaning. Trailing slash of directory is kept.
+func localPath(base string, u *url.URL) string {
+	ret := path.Join(base, u.Host+u.Path)
+	if strings.HasSuffix(u.Path, "/") {
+		ret += "/"
+	}
+	return ret
+}
+
 // SkelPath returns the path to save downloaded data.
 func (c Config) SkelPath(u *url.URL) string {
-	return strings.Join([]string{
-		c.Variables["skel_path"],
-		u.Host + u.Path,
-	}, "/")
+	return localPath(c.Variables["skel_path"], u)
 }
 
 // MirrorPath returns the where downloaded data should be moved to.
 func (c Config) MirrorPath(u *url.URL) string {
-	return strings.Join([]string{
-		c.Variables["mirror_path"],
-		u.Host + u.Path,
-	}, "/")
+	return localPath(c.Variables["mirror_path"], u)
 }
 
 // GetInt returns value of variable in int type. Returns 0 is no such variable or not a number.
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// indexExts are extensions of index file variants we can read, in preferred order.
+// Empty string is the uncompressed one.
+var indexExts = []string{"", ".xz", ".bz2", ".gz", ".lzma", ".zst"}
+
+// decompressors create decompressing reader of supported formats, keyed by extension.
+var decompressors = map[string]func(r io.Reader) (io.ReadCloser, error){
+	".gz": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	".bz2": func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	},
+	".xz": func(r io.Reader) (io.ReadCloser, error) {
+		x, err := xz.NewReader(r)
+		return ioutil.NopCloser(x), err
+	},
+	".lzma": func(r io.Reader) (io.ReadCloser, error) {
+		l, err := lzma.NewReader(r)
+		return ioutil.NopCloser(l), err
+	},
+	".zst": func(r io.Reader) (io.ReadCloser, error) {
+		// single goroutine is enough for index files, and keeps memory usage low
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+}
+
+// compressors create compressing writer of formats we can regenerate, keyed by
+// extension. Default settings are used, so results might differ from upstream.
+var compressors = map[string]func(w io.Writer) (io.WriteCloser, error){
+	".gz": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+	".xz": func(w io.Writer) (io.WriteCloser, error) {
+		return xz.NewWriter(w)
+	},
+	".lzma": func(w io.Writer) (io.WriteCloser, error) {
+		return lzma.NewWriter(w)
+	},
+	".zst": func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	},
+}
+
+type decompressReader struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (d *decompressReader) Close() error {
+	d.ReadCloser.Close()
+	return d.f.Close()
+}
+
+// OpenIndex opens file fn, and decompresses it according to its extension.
+// Files with unknown extension are read as is.
+func OpenIndex(fn string) (io.ReadCloser, error) {
+	for ext := range decompressors {
+		if strings.HasSuffix(fn, ext) {
+			return openIndexAs(fn, ext)
+		}
+	}
+	return openIndexAs(fn, "")
+}
+
+// openIndexAs opens file fn, and decompresses it as format ext, like ".gz".
+// It is read as is if ext is not supported.
+func openIndexAs(fn, ext string) (io.ReadCloser, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	dec, ok := decompressors[ext]
+	if !ok {
+		return f, nil
+	}
+	r, err := dec(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &decompressReader{r, f}, nil
+}
+
+// decompressFile decompresses src, which is compressed in format ext, into dst.
+// dst is replaced only if succeeded.
+func decompressFile(src, dst, ext string) (err error) {
+	in, err := openIndexAs(src, ext)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	// dst might be downloading at the same time, do not share its partial file
+	out, err := ioutil.TempFile(path.Dir(dst), path.Base(dst)+".*"+partialSuffix)
+	if err != nil {
+		return
+	}
+	tmp := out.Name()
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// compressFile compresses src into dst in format ext, like ".gz". dst is replaced
+// only if succeeded.
+func compressFile(src, dst, ext string) (err error) {
+	comp, ok := compressors[ext]
+	if !ok {
+		return fmt.Errorf("cannot compress in format %s", ext)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(path.Dir(dst), path.Base(dst)+".*"+partialSuffix)
+	if err != nil {
+		return
+	}
+	tmp := out.Name()
+	w, err := comp(out)
+	if err == nil {
+		if _, err = io.Copy(w, in); err == nil {
+			err = w.Close()
+		}
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// magics are leading bytes of supported compression formats, keyed by extension.
+var magics = map[string][]byte{
+	".gz":  {0x1f, 0x8b},
+	".bz2": []byte("BZh"),
+	".xz":  {0xfd, '7', 'z', 'X', 'Z', 0x00},
+	".zst": {0x28, 0xb5, 0x2f, 0xfd},
+	// lzma has no magic, but properties and dictionary size used by xz-utils
+	// always start like this
+	".lzma": {0x5d, 0x00, 0x00},
+}
+
+// sniffCompression returns extension of compression format of file fn by its
+// leading bytes, or empty string if not compressed in supported format.
+func sniffCompression(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 6)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	for ext, magic := range magics {
+		if bytes.HasPrefix(buf[:n], magic) {
+			return ext, nil
+		}
+	}
+	return "", nil
+}
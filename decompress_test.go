@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+func xzString(s string) string {
+	buf := new(bytes.Buffer)
+	w, _ := xz.NewWriter(buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.String()
+}
+
+func lzmaString(s string) string {
+	buf := new(bytes.Buffer)
+	w, _ := lzma.NewWriter(buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.String()
+}
+
+func zstdString(s string) string {
+	buf := new(bytes.Buffer)
+	w, _ := zstd.NewWriter(buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.String()
+}
+
+func TestOpenIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := "Package: foo\n"
+	bz2, _ := hex.DecodeString("425a68393141592653590b7930bb000001db0000104000001040002b88a000220681908069a684345ad5d24af1772453850900b7930bb0")
+	data := map[string]string{
+		"Packages":      plain,
+		"Packages.gz":   gzipString(plain),
+		"Packages.bz2":  string(bz2),
+		"Packages.xz":   xzString(plain),
+		"Packages.lzma": lzmaString(plain),
+		"Packages.zst":  zstdString(plain),
+	}
+	for fn, content := range data {
+		p := path.Join(dir, fn)
+		ioutil.WriteFile(p, []byte(content), 0644)
+		if ext, _ := sniffCompression(p); ext != path.Ext(fn) && !(ext == "" && fn == "Packages") {
+			t.Errorf("Expected format of %s is detected, got %#v", fn, ext)
+		}
+		f, err := OpenIndex(p)
+		if err != nil {
+			t.Fatalf("Cannot open %s: %s", fn, err)
+		}
+		actual, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil || string(actual) != plain {
+			t.Errorf("Expected content of %s is %#v, got %#v (%v)", fn, plain, string(actual), err)
+		}
+	}
+
+	dst := path.Join(dir, "decompressed")
+	if err := decompressFile(path.Join(dir, "Packages.xz"), dst, ".xz"); err != nil {
+		t.Fatalf("Cannot decompress: %s", err)
+	}
+	if actual, _ := ioutil.ReadFile(dst); string(actual) != plain {
+		t.Errorf("Expected decompressed content is %#v, got %#v", plain, string(actual))
+	}
+
+	ioutil.WriteFile(path.Join(dir, "broken.xz"), []byte("not xz"), 0644)
+	if err := decompressFile(path.Join(dir, "broken.xz"), dst, ".xz"); err == nil {
+		t.Errorf("Expected error decompressing broken file")
+	}
+	if actual, _ := ioutil.ReadFile(dst); string(actual) != plain {
+		t.Errorf("Expected old file is kept if failed, got %#v", string(actual))
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -8,42 +9,102 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/Patrolavia/ratelimit"
 )
 
-// Downloader is an agent to download some kind of url
+// Downloader is an agent to download some kind of url.
+//
+// Download might be called from multiple goroutines. Returned resp can be nil
+// if the url is not downloaded via http.
 type Downloader interface {
 	Download(u *url.URL, dst string) (resp *http.Response, err error)
 }
 
+// errNotModified is returned by conditional downloads if remote file is not modified.
+var errNotModified = errors.New("not modified")
+
+// ConditionalDownloader is a Downloader which can skip the transfer if remote file
+// is not modified since the version identified by v, errNotModified is returned
+// in such case.
+type ConditionalDownloader interface {
+	DownloadIfModified(u *url.URL, dst string, v Validator) (resp *http.Response, err error)
+}
+
+// IfModified wraps agent to send conditional requests with v. Files are downloaded
+// unconditionally if agent is not a ConditionalDownloader.
+func IfModified(agent Downloader, v Validator) Downloader {
+	return conditionalDownloader{agent, v}
+}
+
+type conditionalDownloader struct {
+	agent Downloader
+	v     Validator
+}
+
+func (c conditionalDownloader) Download(u *url.URL, dst string) (resp *http.Response, err error) {
+	if cd, ok := c.agent.(ConditionalDownloader); ok {
+		return cd.DownloadIfModified(u, dst, c.v)
+	}
+	return c.agent.Download(u, dst)
+}
+
 type invalidDownloader struct {
 	logger func(uri *url.URL) string
-	ch     chan int
 }
 
 func (i *invalidDownloader) Download(u *url.URL, dst string) (resp *http.Response, err error) {
 	log.Fatal(i.logger(u))
-	<-i.ch
 	return
 }
 
 type httpDownloader struct {
 	bucket *ratelimit.Bucket
 	client *http.Client
-	ch     chan int
 }
 
+// Download downloads u into dst. If dst exists, it is treated as partially downloaded
+// data, and we try to resume it with HTTP range request. Server will send whole file
+// if it does not support range request or the file is modified.
 func (h *httpDownloader) Download(u *url.URL, dst string) (resp *http.Response, err error) {
-	defer func() { <-h.ch }()
 	if h.client == nil {
 		h.client = http.DefaultClient
 	}
 
+	return h.get(u, dst, nil)
+}
+
+// DownloadIfModified downloads u into dst only if it is modified since v. Partially
+// downloaded data is always resumed without checking v.
+func (h *httpDownloader) DownloadIfModified(u *url.URL, dst string, v Validator) (resp *http.Response, err error) {
+	if h.client == nil {
+		h.client = http.DefaultClient
+	}
+
+	return h.get(u, dst, &v)
+}
+
+func (h *httpDownloader) get(u *url.URL, dst string, v *Validator) (resp *http.Response, err error) {
+	var offset int64
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
 		return
 	}
+	if stat, e := os.Stat(dst); e == nil && stat.Size() > 0 {
+		// modification time of partial file is set to Last-Modified of the remote file,
+		// server sends whole file if it's been modified since then.
+		offset = stat.Size()
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", stat.ModTime().UTC().Format(http.TimeFormat))
+	} else if v != nil {
+		if v.ETag != "" {
+			req.Header.Set("If-None-Match", v.ETag)
+		}
+		if v.LastModified != "" {
+			req.Header.Set("If-Modified-Since", v.LastModified)
+		}
+	}
 
 	resp, err = h.client.Do(req)
 	if err != nil {
@@ -51,17 +112,38 @@ func (h *httpDownloader) Download(u *url.URL, dst string) (resp *http.Response,
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return resp, errNotModified
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return resp, fmt.Errorf("downloader error downloading %s: unexpected content range %s",
+				u, resp.Header.Get("Content-Range"))
+		}
+		log.Printf("Resuming %s from %d bytes", u, offset)
+		flag = os.O_WRONLY | os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		// partial file is broken, download again from scratch
+		os.Remove(dst)
+		return h.get(u, dst, v)
+	default:
 		return resp, fmt.Errorf("downloader error downloading %s: got http status %s",
 			u, resp.Status)
 	}
 
 	os.MkdirAll(path.Dir(dst), 0755)
-	f, err := os.Create(dst)
+	f, err := os.OpenFile(dst, flag, 0644)
 	if err != nil {
 		return
 	}
-	defer f.Close()
+	defer func() {
+		f.Close()
+		if t, e := http.ParseTime(resp.Header.Get("Last-Modified")); e == nil {
+			os.Chtimes(dst, t, t)
+		}
+	}()
 
 	var src io.Reader = resp.Body
 	if h.bucket != nil {
@@ -72,43 +154,113 @@ func (h *httpDownloader) Download(u *url.URL, dst string) (resp *http.Response,
 	return
 }
 
-// DownloadManager dispatches url to correct downloader, and manages
-// the number of concurrent downloads.
+// partialSuffix is appended to the file name when downloading.
+const partialSuffix = ".partial"
+
+// Fetch downloads u into dst using agent.
+//
+// Data is written into a temporary file first, checked by verify if it is not nil,
+// and renamed to dst only when everything is fine. Nothing is left at dst if failed.
+//
+// The temporary file is kept if the transfer is interrupted, so downloader can
+// resume it next time. It is removed if verification failed.
+func Fetch(agent Downloader, u *url.URL, dst string, verify func(fn string) error) (resp *http.Response, err error) {
+	tmp := dst + partialSuffix
+	if resp, err = agent.Download(u, tmp); err != nil {
+		return
+	}
+	if verify != nil {
+		err = verify(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// DownloadManager dispatches url to correct downloader according to its scheme,
+// and manages the number of concurrent downloads.
+//
+// Downloaders for http, https, ftp and file are registered by default. Other
+// downloaders can be registered with Register, and share the rate limiter via
+// Limit.
 type DownloadManager struct {
-	inv  *invalidDownloader
-	http *httpDownloader
-	ch   chan int
+	inv         *invalidDownloader
+	downloaders map[string]Downloader
+	bucket      *ratelimit.Bucket
+	ch          chan int
 }
 
 /*
 NewManager creates a new DownloadManager.
 
-  logger is a function produce error message when there's unsupported url.
-  bucker is rate limiter.
-  client is http client to download data via http protocol.
-  max is max number of concurrent downloads.
+	logger is a function produce error message when there's unsupported url.
+	bucker is rate limiter.
+	client is http client to download data via http and https protocol.
+	creds is login and password for ftp, credentials of http are handled by client.
+	max is max number of concurrent downloads.
 */
 func NewManager(
 	logger func(uri *url.URL) string,
 	bucket *ratelimit.Bucket,
 	client *http.Client,
+	creds *Credentials,
 	max int,
 ) *DownloadManager {
 
-	ch := make(chan int, max)
+	ret := &DownloadManager{
+		inv:         &invalidDownloader{logger},
+		downloaders: make(map[string]Downloader),
+		bucket:      bucket,
+		ch:          make(chan int, max),
+	}
+	ret.Register(&httpDownloader{bucket, client}, "http", "https")
+	ret.Register(&ftpDownloader{bucket, creds}, "ftp")
+	ret.Register(&fileDownloader{}, "file")
+	return ret
+}
+
+// Register makes dl handle urls of the schemes, replacing downloader registered before.
+func (d *DownloadManager) Register(dl Downloader, schemes ...string) {
+	for _, s := range schemes {
+		d.downloaders[strings.ToLower(s)] = dl
+	}
+}
 
-	return &DownloadManager{
-		inv:  &invalidDownloader{logger, ch},
-		http: &httpDownloader{bucket, client, ch},
-		ch:   ch,
+// Limit wraps r to limit transfer rate. All downloaders share same limit.
+func (d *DownloadManager) Limit(r io.Reader) io.Reader {
+	if d.bucket == nil {
+		return r
 	}
+	return ratelimit.NewReader(r, d.bucket)
+}
+
+// slotDownloader releases the download slot acquired in Dispatch when download finished.
+type slotDownloader struct {
+	Downloader
+	ch chan int
+}
+
+func (s slotDownloader) Download(u *url.URL, dst string) (resp *http.Response, err error) {
+	defer func() { <-s.ch }()
+	return s.Downloader.Download(u, dst)
+}
+
+func (s slotDownloader) DownloadIfModified(u *url.URL, dst string, v Validator) (resp *http.Response, err error) {
+	defer func() { <-s.ch }()
+	return IfModified(s.Downloader, v).Download(u, dst)
 }
 
-// Dispatch returns correct download agnet for the url.
+// Dispatch returns correct download agnet for the url. It blocks until the number of
+// concurrent downloads is less than max, so caller must call Download on returned
+// agent to release the download slot.
 func (d DownloadManager) Dispatch(u *url.URL) Downloader {
 	d.ch <- 1
-	if u.Scheme == "http" {
-		return d.http
+	if dl, ok := d.downloaders[u.Scheme]; ok {
+		return slotDownloader{dl, d.ch}
 	}
-	return d.inv
+	return slotDownloader{d.inv, d.ch}
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func testManager() *DownloadManager {
+	return NewManager(
+		func(u *url.URL) string {
+			return fmt.Sprintf("URL scheme %s of %s is not supported", u.Scheme, u)
+		},
+		nil,
+		http.DefaultClient,
+		nil,
+		1,
+	)
+}
+
+func TestFetch(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir(".")))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dlMgr := testManager()
+	dst := path.Join(dir, "SiteRelease")
+	expect, _ := ioutil.ReadFile("SiteRelease.sample")
+	u, _ := url.Parse(server.URL + "/SiteRelease.sample")
+
+	if _, err := Fetch(dlMgr.Dispatch(u), u, dst, nil); err != nil {
+		t.Fatalf("Cannot download %s: %s", u, err)
+	}
+	if data, _ := ioutil.ReadFile(dst); string(data) != string(expect) {
+		t.Errorf("Downloaded data mismatch")
+	}
+	os.Remove(dst)
+
+	verifyErr := errors.New("verify failed")
+	failed := func(fn string) error {
+		return verifyErr
+	}
+	if _, err := Fetch(dlMgr.Dispatch(u), u, dst, failed); err != verifyErr {
+		t.Errorf("Expected verify error, got %v", err)
+	}
+
+	u, _ = url.Parse(server.URL + "/not-exist")
+	if _, err := Fetch(dlMgr.Dispatch(u), u, dst, nil); err == nil {
+		t.Errorf("Expected error downloading %s", u)
+	}
+
+	if children, _ := ioutil.ReadDir(dir); len(children) != 0 {
+		t.Errorf("Expected nothing left after failed download, got %s", children[0].Name())
+	}
+}
+
+func TestFetchResume(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	modtime := time.Date(2015, 9, 5, 9, 41, 57, 0, time.UTC)
+	var resumed bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/norange" {
+			w.Write(content)
+			return
+		}
+		rec := httptest.NewRecorder()
+		http.ServeContent(rec, r, "", modtime, bytes.NewReader(content))
+		resumed = rec.Code == http.StatusPartialContent
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dlMgr := testManager()
+	dst := path.Join(dir, "file")
+	verify := func(fn string) error {
+		return VerifyFile(fn, int64(len(content)), Checksums{})
+	}
+
+	data := []struct {
+		path    string
+		partial string
+		mtime   time.Time
+		resumed bool
+	}{
+		{"/", "0123456789", modtime, true},
+		{"/", "0123456789", modtime.Add(time.Hour), false}, // modified
+		{"/", "9876543210", modtime.Add(time.Hour), false},
+		{"/", string(content) + "!", modtime, false}, // range not satisfiable
+		{"/norange", "0123456789", modtime, false},
+	}
+	for _, d := range data {
+		ioutil.WriteFile(dst+partialSuffix, []byte(d.partial), 0644)
+		os.Chtimes(dst+partialSuffix, d.mtime, d.mtime)
+
+		u, _ := url.Parse(server.URL + d.path)
+		if _, err := Fetch(dlMgr.Dispatch(u), u, dst, verify); err != nil {
+			t.Errorf("Cannot download %s with partial file %#v: %s", u, d.partial, err)
+			continue
+		}
+		if actual, _ := ioutil.ReadFile(dst); !bytes.Equal(actual, content) {
+			t.Errorf("Downloaded data mismatch with partial file %#v: %s", d.partial, actual)
+		}
+		if d.path == "/" && resumed != d.resumed {
+			t.Errorf("Expected resumed is %v with partial file %#v", d.resumed, d.partial)
+		}
+		os.Remove(dst)
+	}
+}
+
+type testDownloader struct {
+	urls []string
+}
+
+func (d *testDownloader) Download(u *url.URL, dst string) (resp *http.Response, err error) {
+	d.urls = append(d.urls, u.String())
+	return nil, ioutil.WriteFile(dst, []byte(u.String()), 0644)
+}
+
+func TestRegisterDownloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dlMgr := testManager()
+	dl := &testDownloader{}
+	dlMgr.Register(dl, "internal", "INTERNAL2")
+
+	// max concurrent download is 1, download slot must be released after each download.
+	for _, str := range []string{"internal://host/a", "internal2://host/b", "internal://host/c"} {
+		u, _ := url.Parse(str)
+		if _, err := Fetch(dlMgr.Dispatch(u), u, path.Join(dir, u.Path), nil); err != nil {
+			t.Errorf("Cannot download %s: %s", u, err)
+		}
+	}
+
+	if len(dl.urls) != 3 {
+		t.Errorf("Expected 3 urls downloaded by registered downloader, got %v", dl.urls)
+	}
+}
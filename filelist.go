@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// errSuiteUnchanged is returned by DownloadInfoFiles if Release files are same as
+// published ones, so nothing in the suite needs to be mirrored again.
+var errSuiteUnchanged = errors.New("suite is not changed")
+
+// fileListPath returns where the list of package files of r is saved. Settings
+// deciding what to mirror are part of the key, so the suite is not skipped after
+// they are changed.
+func (r Repository) fileListPath(cfg *Config) string {
+	key := strings.Join([]string{
+		r.URL.String(),
+		r.Version,
+		r.Architecture,
+		r.PkgList,
+		strings.Join(r.Components, " "),
+		strings.Join(strings.Fields(cfg.Variables["translations"]), " "),
+		strings.Join(strings.Fields(cfg.Variables["dep11_icons"]), " "),
+		fmt.Sprintf("udeb=%t installer=%t", r.Udeb(cfg), r.Installer(cfg)),
+	}, "\n")
+	return path.Join(cfg.Variables["var_path"], "filelists", fmt.Sprintf("%x", sha1.Sum([]byte(key))))
+}
+
+// SaveFileList saves package files of r, so they can be kept when cleaning if the
+// suite is skipped next time.
+func (r Repository) SaveFileList(cfg *Config, files []*url.URL) error {
+	// paths are relative to mirror_path, which might be changed
+	return writeStateFile(r.fileListPath(cfg), func(w io.Writer) {
+		for _, u := range files {
+			fmt.Fprintln(w, u.Host+u.Path)
+		}
+	})
+}
+
+// LoadFileList returns path in mirror_path of package files saved by SaveFileList.
+func (r Repository) LoadFileList(cfg *Config) ([]string, error) {
+	data, err := ioutil.ReadFile(r.fileListPath(cfg))
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	ret := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if l != "" {
+			ret = append(ret, path.Join(cfg.Variables["mirror_path"], l))
+		}
+	}
+	return ret, nil
+}
+
+// releaseUnchanged tests if Release files downloaded into skel_path are same as
+// published ones in mirror_path.
+func (r Repository) releaseUnchanged(cfg *Config) bool {
+	found := false
+	for _, fn := range releaseFiles {
+		u := r.File(fmt.Sprintf("dists/%s/%s", r.Version, fn))
+		skel, errS := ioutil.ReadFile(cfg.SkelPath(u))
+		mirror, errM := ioutil.ReadFile(cfg.MirrorPath(u))
+		if os.IsNotExist(errS) && os.IsNotExist(errM) {
+			continue
+		}
+		if errS != nil || errM != nil || !bytes.Equal(skel, mirror) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
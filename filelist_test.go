@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSkipUnchangedSuite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "archive")
+	files := map[string]string{
+		"dists/stable/main/binary-amd64/Packages.gz": gzipString("Package: foo\nFilename: pool/main/f/foo/foo_1.0_amd64.deb\nSize: 5\n"),
+	}
+	writeTestArchive(t, archive, "stable", files)
+
+	cfg := testConfig(t, dir, "deb "+archive+" stable main")
+	repo := cfg.Repositories[0]
+	run := func() error {
+		wg := &sync.WaitGroup{}
+		_, err := repo.DownloadInfoFiles(cfg, testManager(), wg)
+		wg.Wait()
+		return err
+	}
+
+	if err := run(); err != nil {
+		t.Fatalf("Cannot download info files: %s", err)
+	}
+	movefiles(cfg.Variables["skel_path"], cfg.Variables["mirror_path"])
+	if err := run(); err != nil {
+		t.Fatalf("Expected suite is not skipped without file list, got %s", err)
+	}
+	movefiles(cfg.Variables["skel_path"], cfg.Variables["mirror_path"])
+
+	pkg := repo.File("pool/main/f/foo/foo_1.0_amd64.deb")
+	if err := repo.SaveFileList(cfg, []*url.URL{pkg}); err != nil {
+		t.Fatalf("Cannot save file list: %s", err)
+	}
+	if err := run(); err != errSuiteUnchanged {
+		t.Fatalf("Expected suite is skipped, got %v", err)
+	}
+	if _, err := os.Stat(cfg.SkelPath(repo.File("dists/stable/Release"))); err == nil {
+		t.Errorf("Expected Release of skipped suite is not published again")
+	}
+	list, err := repo.LoadFileList(cfg)
+	if err != nil {
+		t.Fatalf("Cannot load file list: %s", err)
+	}
+	if expect := []string{cfg.MirrorPath(pkg)}; !reflect.DeepEqual(list, expect) {
+		t.Errorf("Expected file list %v, got %v", expect, list)
+	}
+
+	// settings deciding what to mirror are changed
+	for _, v := range []string{"mirror_udeb", "mirror_installer"} {
+		cfg.Variables[v] = "1"
+		if err := run(); err != nil {
+			t.Errorf("Expected suite is mirrored after %s is changed, got %v", v, err)
+		}
+		cfg.Variables[v] = "0"
+	}
+	p := repo.fileListPath(cfg)
+	cfg.Variables["translations"] = "en de"
+	if repo.fileListPath(cfg) == p {
+		t.Errorf("Expected file list is not reused after translations is changed")
+	}
+	cfg.Variables["translations"] = "en"
+	if err := run(); err != errSuiteUnchanged {
+		t.Fatalf("Expected suite is skipped with original settings, got %v", err)
+	}
+
+	// modified upstream, files in mirror are hardlinks to archive so never write in place
+	os.RemoveAll(archive)
+	files["dists/stable/main/binary-amd64/Packages.gz"] = gzipString("Package: bar\nFilename: pool/main/b/bar/bar_1.0_amd64.deb\nSize: 5\n")
+	writeTestArchive(t, archive, "stable", files)
+	if err := run(); err != nil {
+		t.Errorf("Expected modified suite is mirrored, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Patrolavia/ratelimit"
+)
+
+// ftpTimeout is the timeout to connect to ftp server.
+const ftpTimeout = time.Minute
+
+// ftpConn is a minimal ftp client supporting only what we need: login,
+// query file size and retrieve file in passive mode.
+type ftpConn struct {
+	conn *textproto.Conn
+	host string
+}
+
+// dialFTP connects to the server and login. Credential is searched in creds first,
+// then the url. Anonymous login is used if not found.
+func dialFTP(u *url.URL, creds *Credentials) (c *ftpConn, err error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	nc, err := net.DialTimeout("tcp", addr, ftpTimeout)
+	if err != nil {
+		return
+	}
+	c = &ftpConn{textproto.NewConn(nc), u.Hostname()}
+
+	if _, _, err = c.conn.ReadResponse(220); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	user, pass := "anonymous", "anonymous@"
+	if login, password, ok := creds.Find(u); ok {
+		user, pass = login, password
+	} else if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			pass = p
+		}
+	}
+	code, _, err := c.cmd(0, "USER %s", user)
+	if err == nil && code == 331 {
+		code, _, err = c.cmd(0, "PASS %s", pass)
+	}
+	if err == nil && code != 230 && code != 202 {
+		err = fmt.Errorf("cannot login to %s as %s: got code %d", u.Host, user, code)
+	}
+	if err == nil {
+		_, _, err = c.cmd(200, "TYPE I")
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return
+}
+
+// cmd sends a command and reads its response. expect <= 0 accepts any response code.
+func (c *ftpConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.conn.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.conn.StartResponse(id)
+	defer c.conn.EndResponse(id)
+	return c.conn.ReadResponse(expect)
+}
+
+// Close quits the session and closes the connection.
+func (c *ftpConn) Close() error {
+	c.cmd(0, "QUIT")
+	return c.conn.Close()
+}
+
+// Size returns size of the file, or -1 if server does not support SIZE command.
+func (c *ftpConn) Size(fn string) int64 {
+	_, msg, err := c.cmd(213, "SIZE %s", fn)
+	if err != nil {
+		return -1
+	}
+	sz, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return sz
+}
+
+// passive opens data connection in passive mode, EPSV is preferred.
+// The address in server response is ignored, we always connect to the host
+// of control connection.
+func (c *ftpConn) passive() (net.Conn, error) {
+	var port string
+	if _, msg, err := c.cmd(229, "EPSV"); err == nil {
+		// Entering Extended Passive Mode (|||port|)
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start < 0 || end < start+4 {
+			return nil, fmt.Errorf("invalid EPSV response: %s", msg)
+		}
+		port = msg[start+4 : end]
+	} else {
+		_, msg, err := c.cmd(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		// Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("invalid PASV response: %s", msg)
+		}
+		data := strings.Split(msg[start+1:end], ",")
+		if len(data) != 6 {
+			return nil, fmt.Errorf("invalid PASV response: %s", msg)
+		}
+		p1, err1 := strconv.Atoi(data[4])
+		p2, err2 := strconv.Atoi(data[5])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid PASV response: %s", msg)
+		}
+		port = strconv.Itoa(p1*256 + p2)
+	}
+	return net.DialTimeout("tcp", net.JoinHostPort(c.host, port), ftpTimeout)
+}
+
+// errRestNotSupported denotes the server refuses to resume transfer.
+var errRestNotSupported = errors.New("server does not support REST")
+
+// Retr retrieves the file from offset, and copies its content to w.
+// Transfer rate is limited if bucket is not nil. errRestNotSupported is
+// returned if offset is not 0 and the server cannot resume.
+func (c *ftpConn) Retr(fn string, offset int64, w io.Writer, bucket *ratelimit.Bucket) (n int64, err error) {
+	if offset > 0 {
+		if _, _, e := c.cmd(350, "REST %d", offset); e != nil {
+			return 0, errRestNotSupported
+		}
+	}
+
+	dc, err := c.passive()
+	if err != nil {
+		return
+	}
+	defer dc.Close()
+
+	if _, _, err = c.cmd(1, "RETR %s", fn); err != nil {
+		return
+	}
+
+	var src io.Reader = dc
+	if bucket != nil {
+		src = ratelimit.NewReader(dc, bucket)
+	}
+	n, err = io.Copy(w, src)
+	dc.Close()
+	if _, _, e := c.conn.ReadResponse(2); err == nil {
+		err = e
+	}
+	return
+}
+
+type ftpDownloader struct {
+	bucket *ratelimit.Bucket
+	creds  *Credentials
+}
+
+// Download downloads u into dst in passive mode. If dst exists, it is treated as partially
+// downloaded data, and we try to resume it. Returned resp is always nil.
+func (f *ftpDownloader) Download(u *url.URL, dst string) (resp *http.Response, err error) {
+	c, err := dialFTP(u, f.creds)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	size := c.Size(u.Path)
+	var offset int64
+	if stat, e := os.Stat(dst); e == nil && size > 0 && stat.Size() > 0 && stat.Size() < size {
+		offset = stat.Size()
+		log.Printf("Resuming %s from %d bytes", u, offset)
+	}
+
+	os.MkdirAll(path.Dir(dst), 0755)
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flag = os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(dst, flag, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	n, err := c.Retr(u.Path, offset, file, f.bucket)
+	if err == errRestNotSupported {
+		// partial data is useless, or we would try to resume forever
+		log.Printf("Cannot resume %s, download from beginning", u)
+		if err = file.Truncate(0); err != nil {
+			return
+		}
+		offset = 0
+		n, err = c.Retr(u.Path, offset, file, f.bucket)
+	}
+	if err == nil && size >= 0 && offset+n != size {
+		err = fmt.Errorf("downloader error downloading %s: got %d bytes, expected %d",
+			u, offset+n, size)
+	}
+	return
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeFTPServer serves files in passive mode, just enough to test ftpDownloader.
+type fakeFTPServer struct {
+	l     net.Listener
+	files map[string]string
+	sizes map[string]int // fake SIZE response
+	user  string
+	pass  string
+	// noRest makes the server refuse REST command
+	noRest bool
+}
+
+func newFakeFTPServer(t *testing.T) *fakeFTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	s := &fakeFTPServer{l: l, files: make(map[string]string), sizes: make(map[string]int)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeFTPServer) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(c, format+"\r\n", args...)
+	}
+
+	var data net.Listener
+	var user string
+	offset := 0
+	reply("220 fake ftp")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		arr := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		arg := ""
+		if len(arr) > 1 {
+			arg = arr[1]
+		}
+		switch arr[0] {
+		case "USER":
+			user = arg
+			reply("331 password please")
+		case "PASS":
+			if user != s.user || arg != s.pass {
+				reply("530 login incorrect")
+				continue
+			}
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 ok")
+		case "SIZE":
+			if sz, ok := s.sizes[arg]; ok {
+				reply("213 %d", sz)
+			} else if f, ok := s.files[arg]; ok {
+				reply("213 %d", len(f))
+			} else {
+				reply("550 not found")
+			}
+		case "EPSV":
+			reply("502 not implemented")
+		case "PASV":
+			data, _ = net.Listen("tcp", "127.0.0.1:0")
+			port := data.Addr().(*net.TCPAddr).Port
+			reply("227 Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256)
+		case "REST":
+			if s.noRest {
+				reply("502 not implemented")
+				continue
+			}
+			offset, _ = strconv.Atoi(arg)
+			reply("350 ok")
+		case "RETR":
+			f, ok := s.files[arg]
+			if !ok {
+				reply("550 not found")
+				continue
+			}
+			reply("150 opening data connection")
+			dc, err := data.Accept()
+			if err != nil {
+				return
+			}
+			dc.Write([]byte(f[offset:]))
+			dc.Close()
+			data.Close()
+			offset = 0
+			reply("226 done")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestFTPDownloader(t *testing.T) {
+	server := newFakeFTPServer(t)
+	defer server.l.Close()
+	server.user, server.pass = "anonymous", "anonymous@"
+	server.files["/debian/a.deb"] = "0123456789abcdefghijklmnopqrstuvwxyz"
+	server.files["/debian/short.deb"] = "0123456789"
+	server.sizes["/debian/short.deb"] = 20
+
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dlMgr := testManager()
+	dst := path.Join(dir, "a.deb")
+	base := "ftp://" + server.l.Addr().String()
+
+	u, _ := url.Parse(base + "/debian/a.deb")
+	if _, err := Fetch(dlMgr.Dispatch(u), u, dst, nil); err != nil {
+		t.Fatalf("Cannot download %s: %s", u, err)
+	}
+	if data, _ := ioutil.ReadFile(dst); string(data) != server.files["/debian/a.deb"] {
+		t.Errorf("Downloaded data mismatch: %s", data)
+	}
+	os.Remove(dst)
+
+	// resume
+	ioutil.WriteFile(dst+partialSuffix, []byte("0123456789"), 0644)
+	if _, err := Fetch(dlMgr.Dispatch(u), u, dst, nil); err != nil {
+		t.Fatalf("Cannot resume %s: %s", u, err)
+	}
+	if data, _ := ioutil.ReadFile(dst); string(data) != server.files["/debian/a.deb"] {
+		t.Errorf("Resumed data mismatch: %s", data)
+	}
+	os.Remove(dst)
+
+	// server refusing to resume
+	server.noRest = true
+	ioutil.WriteFile(dst+partialSuffix, []byte("0123456789"), 0644)
+	if _, err := Fetch(dlMgr.Dispatch(u), u, dst, nil); err != nil {
+		t.Fatalf("Cannot download %s without resuming: %s", u, err)
+	}
+	if data, _ := ioutil.ReadFile(dst); string(data) != server.files["/debian/a.deb"] {
+		t.Errorf("Data downloaded without resuming mismatch: %s", data)
+	}
+	os.Remove(dst)
+	server.noRest = false
+
+	u, _ = url.Parse(base + "/debian/short.deb")
+	if _, err := Fetch(dlMgr.Dispatch(u), u, dst, nil); err == nil {
+		t.Errorf("Expected size mismatch downloading %s", u)
+	}
+	os.Remove(dst + partialSuffix)
+
+	// credentialed login
+	server.user, server.pass = "user", "secret"
+	u, _ = url.Parse(base + "/debian/a.deb")
+	if _, err := Fetch(dlMgr.Dispatch(u), u, dst, nil); err == nil {
+		t.Errorf("Expected anonymous login fails")
+	}
+	u, _ = url.Parse("ftp://user:secret@" + server.l.Addr().String() + "/debian/a.deb")
+	if _, err := Fetch(dlMgr.Dispatch(u), u, dst, nil); err != nil {
+		t.Errorf("Cannot download %s with credentials: %s", u, err)
+	}
+}
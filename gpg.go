@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+var errNoSignature = errors.New("no signature found")
+
+// ReadKeyring reads OpenPGP public keys from file, which can be either binary
+// (like files in /etc/apt/trusted.gpg.d) or ASCII armored format.
+func ReadKeyring(fn string) (ret openpgp.EntityList, err error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return
+	}
+
+	if ret, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data)); err == nil {
+		return
+	}
+	if ret, err = openpgp.ReadKeyRing(bytes.NewReader(data)); err != nil {
+		err = fmt.Errorf("cannot read keyring %s: %s", fn, err)
+	}
+	return
+}
+
+// VerifyDetached checks if sig is a valid detached signature of signed data,
+// made by an unexpired key in keyring. sig can be either binary or ASCII armored.
+func VerifyDetached(keyring openpgp.EntityList, signed, sig []byte) error {
+	return checkSignature(keyring, signed, sig, time.Now())
+}
+
+// VerifyClearsigned checks clearsigned message like InRelease file, and returns
+// the signed text if the signature is valid.
+func VerifyClearsigned(keyring openpgp.EntityList, data []byte) (ret []byte, err error) {
+	block, _ := clearsign.Decode(data)
+	if block == nil {
+		return nil, errNoSignature
+	}
+
+	sig, err := ioutil.ReadAll(block.ArmoredSignature.Body)
+	if err != nil {
+		return
+	}
+	if err = checkSignature(keyring, block.Bytes, sig, time.Now()); err != nil {
+		return
+	}
+	return block.Plaintext, nil
+}
+
+func checkSignature(keyring openpgp.EntityList, signed, sig []byte, now time.Time) error {
+	var r io.Reader = bytes.NewReader(sig)
+	if block, err := armor.Decode(bytes.NewReader(sig)); err == nil {
+		r = block.Body
+	}
+
+	err := errNoSignature
+	packets := packet.NewReader(r)
+	for {
+		p, e := packets.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return e
+		}
+
+		s, ok := p.(*packet.Signature)
+		if !ok || s.IssuerKeyId == nil {
+			continue
+		}
+
+		keys := keyring.KeysByIdUsage(*s.IssuerKeyId, packet.KeyFlagSign)
+		if len(keys) == 0 {
+			err = fmt.Errorf("signature made by unknown key %016X", *s.IssuerKeyId)
+			continue
+		}
+		if s.SigLifetimeSecs != nil && *s.SigLifetimeSecs != 0 {
+			expire := s.CreationTime.Add(time.Duration(*s.SigLifetimeSecs) * time.Second)
+			if now.After(expire) {
+				err = fmt.Errorf("signature made by key %016X expired at %s", *s.IssuerKeyId, expire)
+				continue
+			}
+		}
+		if !s.Hash.Available() {
+			err = fmt.Errorf("unsupported hash function %d", s.Hash)
+			continue
+		}
+
+		for _, key := range keys {
+			if key.SelfSignature != nil && key.SelfSignature.KeyExpired(now) {
+				err = fmt.Errorf("key %016X has expired", key.PublicKey.KeyId)
+				continue
+			}
+
+			h := s.Hash.New()
+			h.Write(signed)
+			if err = key.PublicKey.VerifySignature(h, s); err == nil {
+				return nil
+			}
+		}
+	}
+
+	return err
+}
+
+// ClearsignedText returns the text of clearsigned message without verifying it.
+func ClearsignedText(data []byte) ([]byte, error) {
+	block, _ := clearsign.Decode(data)
+	if block == nil {
+		return nil, errNoSignature
+	}
+	return block.Plaintext, nil
+}
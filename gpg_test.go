@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+const testRelease = `Origin: Test
+Suite: stable
+MD5Sum:
+ 5d41402abc4b2a76b9719d911017c592 5 main/binary-amd64/Packages
+`
+
+// newTestKeyring creates a throwaway key, and writes public part of it into a keyring file.
+func newTestKeyring(t *testing.T, dir string) (*openpgp.Entity, string) {
+	e, err := openpgp.NewEntity("apt-mirror-go test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %s", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := e.Serialize(buf); err != nil {
+		t.Fatalf("Cannot serialize key: %s", err)
+	}
+	fn := path.Join(dir, "keyring.gpg")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Cannot write keyring: %s", err)
+	}
+	return e, fn
+}
+
+func TestVerifyDetached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	signer, fn := newTestKeyring(t, dir)
+	keyring, err := ReadKeyring(fn)
+	if err != nil {
+		t.Fatalf("Cannot read keyring: %s", err)
+	}
+
+	sig := new(bytes.Buffer)
+	if err := openpgp.ArmoredDetachSign(sig, signer, bytes.NewBufferString(testRelease), nil); err != nil {
+		t.Fatalf("Cannot sign: %s", err)
+	}
+
+	if err := VerifyDetached(keyring, []byte(testRelease), sig.Bytes()); err != nil {
+		t.Errorf("Expected valid signature, got %s", err)
+	}
+	if err := VerifyDetached(keyring, []byte(testRelease+" "), sig.Bytes()); err == nil {
+		t.Errorf("Expected tampered data fails verification")
+	}
+	if err := VerifyDetached(keyring, []byte(testRelease), nil); err == nil {
+		t.Errorf("Expected missing signature fails verification")
+	}
+
+	other, _ := newTestKeyring(t, dir)
+	sig.Reset()
+	if err := openpgp.DetachSign(sig, other, bytes.NewBufferString(testRelease), nil); err != nil {
+		t.Fatalf("Cannot sign: %s", err)
+	}
+	if err := VerifyDetached(keyring, []byte(testRelease), sig.Bytes()); err == nil {
+		t.Errorf("Expected signature made by unknown key fails verification")
+	}
+}
+
+func TestVerifyExpiredKey(t *testing.T) {
+	signer, err := openpgp.NewEntity("apt-mirror-go test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %s", err)
+	}
+	lifetime := uint32(3600)
+	for _, id := range signer.Identities {
+		id.SelfSignature.KeyLifetimeSecs = &lifetime
+		if err := id.SelfSignature.SignUserId(id.UserId.Id, signer.PrimaryKey, signer.PrivateKey, nil); err != nil {
+			t.Fatalf("Cannot sign user id: %s", err)
+		}
+	}
+
+	sig := new(bytes.Buffer)
+	if err := openpgp.DetachSign(sig, signer, bytes.NewBufferString(testRelease), nil); err != nil {
+		t.Fatalf("Cannot sign: %s", err)
+	}
+
+	keyring := openpgp.EntityList{signer}
+	if err := checkSignature(keyring, []byte(testRelease), sig.Bytes(), time.Now()); err != nil {
+		t.Errorf("Expected valid signature, got %s", err)
+	}
+	if err := checkSignature(keyring, []byte(testRelease), sig.Bytes(), time.Now().Add(2*time.Hour)); err == nil {
+		t.Errorf("Expected signature made by expired key fails verification")
+	}
+}
+
+func TestVerifyClearsigned(t *testing.T) {
+	signer, err := openpgp.NewEntity("apt-mirror-go test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %s", err)
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := clearsign.Encode(buf, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatalf("Cannot clearsign: %s", err)
+	}
+	w.Write([]byte(testRelease))
+	w.Close()
+
+	keyring := openpgp.EntityList{signer}
+	data, err := VerifyClearsigned(keyring, buf.Bytes())
+	if err != nil {
+		t.Fatalf("Expected valid signature, got %s", err)
+	}
+	if string(data) != testRelease {
+		t.Errorf("Expected signed text %#v, got %#v", testRelease, string(data))
+	}
+
+	tampered := bytes.Replace(buf.Bytes(), []byte("Suite: stable"), []byte("Suite: stale"), 1)
+	if _, err := VerifyClearsigned(keyring, tampered); err == nil {
+		t.Errorf("Expected tampered data fails verification")
+	}
+	if _, err := VerifyClearsigned(keyring, []byte(testRelease)); err == nil {
+		t.Errorf("Expected unsigned data fails verification")
+	}
+}
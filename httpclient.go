@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+NewHTTPClient creates http client according to config variables:
+
+	ca_certificate is path to CA bundle (PEM format) trusted in addition to system ones.
+	certificate and private_key are paths to client certificate and its key (PEM format).
+	no_check_certificate disables server certificate verification if set to 1.
+	use_proxy, http_proxy, https_proxy, proxy_user, proxy_password and no_proxy
+	controls proxy, see NewProxyFunc for detail.
+
+Basic auth header is added if the url matches cfg.Credentials.
+*/
+func NewHTTPClient(cfg *Config) (*http.Client, error) {
+	tlsCfg := &tls.Config{}
+
+	if fn := cfg.Variables["ca_certificate"]; fn != "" {
+		pem, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA bundle %s: %s", fn, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", fn)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	cert, key := cfg.Variables["certificate"], cfg.Variables["private_key"]
+	if cert != "" || key != "" {
+		if key == "" {
+			// private key might be placed in same file
+			key = cert
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate %s: %s", cert, err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{pair}
+	}
+
+	if cfg.GetInt("no_check_certificate") == 1 {
+		tlsCfg.InsecureSkipVerify = true
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	if useProxy(cfg) {
+		proxy, err := NewProxyFunc(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = proxy
+	}
+	return &http.Client{Transport: &authTransport{transport, cfg.Credentials}}, nil
+}
+
+func useProxy(cfg *Config) bool {
+	switch strings.ToLower(cfg.Variables["use_proxy"]) {
+	case "on", "yes", "1":
+		return true
+	}
+	return false
+}
+
+/*
+NewProxyFunc creates a function choosing proxy for http requests, in apt-mirror compatible way.
+
+	http_proxy is the proxy for http, and for https if https_proxy is not set.
+	proxy_user and proxy_password are credentials of the proxies.
+	no_proxy is a space or comma delimited list of hosts (and their subdomains)
+	accessed without proxy.
+
+Repositories with option "proxy=no", like "deb [proxy=no] http://...", are
+accessed without proxy too.
+*/
+func NewProxyFunc(cfg *Config) (func(*http.Request) (*url.URL, error), error) {
+	parse := func(s string) (*url.URL, error) {
+		if s == "" {
+			return nil, nil
+		}
+		if !strings.Contains(s, "://") {
+			// apt-mirror accepts host:port
+			s = "http://" + s
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %s", s, err)
+		}
+		if user := cfg.Variables["proxy_user"]; user != "" {
+			u.User = url.UserPassword(user, cfg.Variables["proxy_password"])
+		}
+		return u, nil
+	}
+
+	httpProxy, err := parse(cfg.Variables["http_proxy"])
+	if err != nil {
+		return nil, err
+	}
+	httpsProxy, err := parse(cfg.Variables["https_proxy"])
+	if err != nil {
+		return nil, err
+	}
+	if httpsProxy == nil {
+		httpsProxy = httpProxy
+	}
+
+	noProxy := strings.FieldsFunc(cfg.Variables["no_proxy"], func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	prefixes := make([]string, 0)
+	for _, repo := range cfg.Repositories {
+		if repo.Options["proxy"] == "no" {
+			prefixes = append(prefixes, repo.URL.String())
+		}
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		host := strings.ToLower(req.URL.Hostname())
+		for _, h := range noProxy {
+			h = strings.ToLower(strings.TrimPrefix(h, "."))
+			if host == h || strings.HasSuffix(host, "."+h) {
+				return nil, nil
+			}
+		}
+		for _, p := range prefixes {
+			if strings.HasPrefix(req.URL.String(), p) {
+				return nil, nil
+			}
+		}
+
+		if req.URL.Scheme == "https" {
+			return httpsProxy, nil
+		}
+		return httpProxy, nil
+	}, nil
+}
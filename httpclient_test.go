@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert generates a self-signed client certificate, and writes it with its key into dir.
+func writeTestCert(t *testing.T, dir string) (cert, key string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "apt-mirror-go test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("Cannot create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Cannot marshal key: %s", err)
+	}
+
+	cert = path.Join(dir, "client.crt")
+	key = path.Join(dir, "client.key")
+	ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return
+}
+
+func TestHTTPSClient(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.FileServer(http.Dir(".")))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := path.Join(dir, "ca.pem")
+	ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+	cert, key := writeTestCert(t, dir)
+
+	data := []struct {
+		vars   map[string]string
+		expect bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"ca_certificate": ca}, true},
+		{map[string]string{"no_check_certificate": "1"}, true},
+		{map[string]string{"ca_certificate": ca, "certificate": cert, "private_key": key}, true},
+	}
+
+	u, _ := url.Parse(server.URL + "/SiteRelease.sample")
+	for _, d := range data {
+		var clientCert bool
+		server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientCert = len(r.TLS.PeerCertificates) > 0
+			http.ServeFile(w, r, "SiteRelease.sample")
+		})
+
+		client, err := NewHTTPClient(&Config{Variables: d.vars})
+		if err != nil {
+			t.Fatalf("Cannot create client with %v: %s", d.vars, err)
+		}
+		dlMgr := NewManager(nil, nil, client, nil, 1)
+		dst := path.Join(dir, "SiteRelease")
+		_, err = Fetch(dlMgr.Dispatch(u), u, dst, nil)
+		if (err == nil) != d.expect {
+			t.Errorf("Downloading with %v: expected success is %v, got error %v", d.vars, d.expect, err)
+		}
+		if err == nil && clientCert != (d.vars["certificate"] != "") {
+			t.Errorf("Downloading with %v: client certificate sent is %v", d.vars, clientCert)
+		}
+		os.Remove(dst)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var proxyAuth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyAuth = r.Header.Get("Proxy-Authorization")
+		w.Write([]byte(r.URL.String()))
+	}))
+	defer proxy.Close()
+
+	cfg, err := ParseConfig(`set use_proxy on
+set http_proxy ` + strings.TrimPrefix(proxy.URL, "http://") + `
+set proxy_user user
+set proxy_password secret
+set no_proxy .local.example.com
+deb http://ftp.tw.debian.org/debian stable main
+deb [proxy=no] http://internal.example.com/debian stable main
+`)
+	if err != nil {
+		t.Fatalf("Cannot parse config: %s", err)
+	}
+	client, err := NewHTTPClient(cfg)
+	if err != nil {
+		t.Fatalf("Cannot create client: %s", err)
+	}
+
+	data := map[string]bool{
+		"http://ftp.tw.debian.org/debian/dists/stable/Release":        true,
+		"https://ftp.tw.debian.org/debian/dists/stable/Release":       true,
+		"http://internal.example.com/debian/dists/stable/Release":     false,
+		"http://internal.example.com/other/dists/stable/Release":      true,
+		"http://mirror.local.example.com/debian/dists/stable/Release": false,
+		"http://local.example.com/debian/dists/stable/Release":        false,
+	}
+	proxyFunc := client.Transport.(*authTransport).base.(*http.Transport).Proxy
+	for str, expect := range data {
+		req, _ := http.NewRequest("GET", str, nil)
+		p, err := proxyFunc(req)
+		if err != nil {
+			t.Errorf("Cannot choose proxy for %s: %s", str, err)
+		}
+		if (p != nil) != expect {
+			t.Errorf("Expected using proxy for %s is %v, got %v", str, expect, p)
+		}
+	}
+
+	resp, err := client.Get("http://ftp.tw.debian.org/debian/dists/stable/Release")
+	if err != nil {
+		t.Fatalf("Cannot download via proxy: %s", err)
+	}
+	resp.Body.Close()
+	if proxyAuth != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("Expected proxy credentials, got %#v", proxyAuth)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Installer reports whether installer images (like netboot) are mirrored, which is
+// enabled by "installer=yes" option or mirror_installer variable.
+func (r Repository) Installer(cfg *Config) bool {
+	if r.Architecture == "src" || r.Architecture == "all" {
+		return false
+	}
+	return r.optIn(cfg, "installer", "mirror_installer")
+}
+
+// installerDir returns path of installer images of component c, relative to
+// dists/<suite>.
+func (r Repository) installerDir(c string) string {
+	return fmt.Sprintf("%s/installer-%s", c, r.Architecture)
+}
+
+// installerVersion returns name of directory in installer-<arch> of component c,
+// which "current" links to upstream. It is found by comparing SHA256SUMS files
+// listed in Release file, and is "current" itself if no other one matches. ok is
+// false if installer images are not listed.
+func (r Repository) installerVersion(release *Release, c string) (ver string, ok bool) {
+	prefix := r.installerDir(c) + "/"
+	suffix := "/images/SHA256SUMS"
+	cur, ok := release.Files[prefix+"current"+suffix]
+	if !ok {
+		return "", false
+	}
+	for name, f := range release.Files {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		v := strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
+		if v != "current" && !strings.Contains(v, "/") && f.Size == cur.Size && f.Checksums == cur.Checksums {
+			return v, true
+		}
+	}
+	return "current", true
+}
+
+// prepareInstaller creates "current" symlink of component c in skel_path, and
+// returns url of SHA256SUMS listing installer images to download.
+func (r Repository) prepareInstaller(cfg *Config, c, ver string) (*url.URL, error) {
+	dir := fmt.Sprintf("dists/%s/%s", r.Version, r.installerDir(c))
+	if ver != "current" {
+		link := cfg.SkelPath(r.File(dir + "/current"))
+		if err := os.MkdirAll(path.Dir(link), 0755); err != nil {
+			return nil, err
+		}
+		os.Remove(link)
+		if err := os.Symlink(ver, link); err != nil {
+			return nil, err
+		}
+	}
+	return r.File(fmt.Sprintf("%s/%s/images/SHA256SUMS", dir, ver)), nil
+}
+
+// InstallerImages parses SHA256SUMS of component c in skel_path, and returns
+// installer images listed in it. Size of images is unknown, so they are verified
+// only by checksums.
+//
+// The "current" symlink, which must be kept when cleaning, is returned as link.
+func (r Repository) InstallerImages(cfg *Config, c string) (ret []Package, link *url.URL, err error) {
+	dir := fmt.Sprintf("dists/%s/%s", r.Version, r.installerDir(c))
+	link = r.File(dir + "/current")
+	ver := "current"
+	if target, err := os.Readlink(cfg.SkelPath(link)); err == nil {
+		ver = target
+	}
+
+	f, err := os.Open(cfg.SkelPath(r.File(fmt.Sprintf("%s/%s/images/SHA256SUMS", dir, ver))))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		data := strings.Fields(scanner.Text())
+		if len(data) == 0 {
+			continue
+		}
+		if len(data) != 2 {
+			return nil, nil, fmt.Errorf("format error: %#v", scanner.Text())
+		}
+		fn := path.Clean(data[1])
+		if path.IsAbs(fn) || strings.HasPrefix(fn, "../") || fn == ".." {
+			return nil, nil, fmt.Errorf("invalid file name %#v", data[1])
+		}
+		ret = append(ret, Package{
+			URL:       r.File(fmt.Sprintf("%s/%s/images/%s", dir, ver, fn)),
+			Size:      -1,
+			Checksums: Checksums{SHA256: strings.ToLower(data[0])},
+		})
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestInstallerImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := "netboot image"
+	sums := fmt.Sprintf("%x  ./netboot/netboot.tar.gz\n", sha256.Sum256([]byte(image)))
+	archive := path.Join(dir, "archive")
+	writeTestArchive(t, archive, "stable", map[string]string{
+		"dists/stable/main/binary-amd64/Packages":                                  "",
+		"dists/stable/main/installer-amd64/20230607/images/SHA256SUMS":             sums,
+		"dists/stable/main/installer-amd64/20230607/images/netboot/netboot.tar.gz": image,
+		"dists/stable/main/installer-amd64/20210731/images/SHA256SUMS":             "old",
+		"dists/stable/main/installer-amd64/current/images/SHA256SUMS":              sums,
+	})
+
+	cfg := testConfig(t, dir, "deb [installer=yes] "+archive+" stable main")
+	repo := cfg.Repositories[0]
+	if !repo.Installer(cfg) {
+		t.Fatalf("Expected installer=yes enables installer images")
+	}
+	wg := &sync.WaitGroup{}
+	dlMgr := testManager()
+	if _, err := repo.DownloadInfoFiles(cfg, dlMgr, wg); err != nil {
+		t.Fatalf("Cannot download info files: %s", err)
+	}
+	wg.Wait()
+
+	link := cfg.SkelPath(repo.File("dists/stable/main/installer-amd64/current"))
+	if target, err := os.Readlink(link); err != nil || target != "20230607" {
+		t.Fatalf("Expected current links to 20230607, got %#v (%v)", target, err)
+	}
+
+	images, l, err := repo.InstallerImages(cfg, "main")
+	if err != nil || len(images) != 1 {
+		t.Fatalf("Expected 1 installer image, got %d (%v)", len(images), err)
+	}
+	if cfg.SkelPath(l) != link {
+		t.Errorf("Expected symlink is %s, got %s", link, cfg.SkelPath(l))
+	}
+	p := images[0]
+	if expect := "/dists/stable/main/installer-amd64/20230607/images/netboot/netboot.tar.gz"; p.URL.Path != archive+expect {
+		t.Errorf("Unexpected url of installer image: %s", p.URL)
+	}
+	if err := p.Download(cfg, dlMgr.Dispatch(p.URL)); err != nil {
+		t.Fatalf("Cannot download %s: %s", p.URL, err)
+	}
+	if !p.Test(cfg) {
+		t.Errorf("Expected %s is downloaded correctly", p.URL)
+	}
+
+	movefiles(cfg.Variables["skel_path"], cfg.Variables["mirror_path"])
+	data, err := ioutil.ReadFile(cfg.MirrorPath(repo.File("dists/stable/main/installer-amd64/current/images/netboot/netboot.tar.gz")))
+	if err != nil || string(data) != image {
+		t.Errorf("Expected image is reachable through current in mirror, got %#v (%v)", string(data), err)
+	}
+
+	cfg = testConfig(t, dir, "deb-src [installer=yes] "+archive+" stable main")
+	if cfg.Repositories[0].Installer(cfg) {
+		t.Errorf("Expected no installer images for source repository")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+)
+
+// fileDownloader "downloads" files from local filesystem, like a mounted DVD image
+// or NFS-mounted archive.
+type fileDownloader struct{}
+
+// Download hardlinks the file to dst if they are on same filesystem, or copies it.
+// Returned resp is always nil.
+func (f *fileDownloader) Download(u *url.URL, dst string) (resp *http.Response, err error) {
+	stat, err := os.Stat(u.Path)
+	if err != nil {
+		return
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, fmt.Errorf("downloader error downloading %s: not a regular file", u)
+	}
+
+	err = linkFile(u.Path, dst)
+	return
+}
+
+// linkFile hardlinks src to dst, or copies it if they are not on same filesystem.
+func linkFile(src, dst string) error {
+	os.MkdirAll(path.Dir(dst), 0755)
+	// never write into existing file, it might be a hardlink to source file.
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
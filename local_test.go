@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func gzipString(s string) string {
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.String()
+}
+
+// storedGzipString returns valid gzipped s without compression, which is larger than s.
+func storedGzipString(s string) string {
+	buf := new(bytes.Buffer)
+	w, _ := gzip.NewWriterLevel(buf, gzip.NoCompression)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.String()
+}
+
+// writeTestArchive writes files into dir, and generates Release file for the
+// suite listing all files in dists/<suite>.
+func writeTestArchive(t *testing.T, dir, suite string, files map[string]string) {
+	names := make([]string, 0, len(files))
+	for fn, content := range files {
+		p := path.Join(dir, fn)
+		os.MkdirAll(path.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("Cannot write %s: %s", p, err)
+		}
+		prefix := "dists/" + suite + "/"
+		if strings.HasPrefix(fn, prefix) {
+			names = append(names, fn[len(prefix):])
+		}
+	}
+	sort.Strings(names)
+
+	rel := "Origin: Test\nSuite: " + suite + "\nMD5Sum:\n"
+	for _, n := range names {
+		c := files["dists/"+suite+"/"+n]
+		rel += fmt.Sprintf(" %x %d %s\n", md5.Sum([]byte(c)), len(c), n)
+	}
+	rel += "SHA256:\n"
+	for _, n := range names {
+		c := files["dists/"+suite+"/"+n]
+		rel += fmt.Sprintf(" %x %d %s\n", sha256.Sum256([]byte(c)), len(c), n)
+	}
+	ioutil.WriteFile(path.Join(dir, "dists", suite, "Release"), []byte(rel), 0644)
+}
+
+// testConfig creates a config mirroring repo in dir, with skel and mirror path in dir
+func testConfig(t *testing.T, dir, repo string) *Config {
+	cfg, err := ParseConfig(fmt.Sprintf(`set base_path %s
+set mirror_path $base_path/mirror
+set skel_path $base_path/skel
+set var_path $base_path/var
+set defaultarch amd64
+%s
+`, dir, repo))
+	if err != nil {
+		t.Fatalf("Cannot parse config: %s", err)
+	}
+	return cfg
+}
+
+func TestLocalRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "archive")
+	writeTestArchive(t, archive, "stable", map[string]string{
+		"dists/stable/main/binary-amd64/Packages.gz": gzipString(
+			"Package: foo\nFilename: pool/main/f/foo/foo_1.0_amd64.deb\nSize: 5\n" +
+				"SHA256: 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\n"),
+		"pool/main/f/foo/foo_1.0_amd64.deb": "hello",
+	})
+
+	cfg := testConfig(t, dir, "deb "+archive+" stable main")
+	repo := cfg.Repositories[0]
+	if repo.URL.Scheme != "file" {
+		t.Fatalf("Expected local path is parsed as file url, got %s", repo.URL)
+	}
+
+	wg := &sync.WaitGroup{}
+	dlMgr := testManager()
+	if _, err := repo.DownloadInfoFiles(cfg, dlMgr, wg); err != nil {
+		t.Fatalf("Cannot download info files: %s", err)
+	}
+	wg.Wait()
+
+	f, err := os.Open(cfg.SkelPath(repo.PackagesGZ("main")))
+	if err != nil {
+		t.Fatalf("Cannot open Packages file: %s", err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Cannot decompress Packages file: %s", err)
+	}
+	pkgs, err := ParsePackage(repo, r)
+	if err != nil || len(pkgs) != 1 {
+		t.Fatalf("Expected 1 package, got %d, %v", len(pkgs), err)
+	}
+
+	p := pkgs[0]
+	if err := p.Download(cfg, dlMgr.Dispatch(p.URL)); err != nil {
+		t.Fatalf("Cannot download %s: %s", p.URL, err)
+	}
+	if !p.Test(cfg) {
+		t.Errorf("Expected %s is downloaded correctly", p.URL)
+	}
+}
@@ -12,9 +12,10 @@ import (
 
 // Package denotes a remote Debian package file.
 type Package struct {
-	URL    *url.URL
-	Size   int64
-	MD5Sum string
+	URL *url.URL
+	// Size is -1 if unknown, like installer images.
+	Size int64
+	Checksums
 }
 
 // ParsePackage parses Debian Packages or Sources file to find out all package files.
@@ -22,23 +23,46 @@ func ParsePackage(repo Repository, r io.Reader) (ret []Package, err error) {
 	// src is how we parse Debian Sources file
 	src := func(p string) (err error) {
 		c := ParseControlFile(p)
-		fs, fsok := c["Files"]
 		dir := strings.TrimSpace(c.Get("Directory"))
-		if !fsok || dir == "" {
+		if dir == "" {
 			return
 		}
-		for _, f := range fs {
-			data := strings.Split(strings.TrimSpace(f), " ")
-			if len(data) != 3 {
-				continue
-			}
-			u := repo.File(path.Join(dir, data[2]))
 
-			sz, err := strconv.ParseInt(data[1], 10, 64)
-			if err != nil {
-				return err
+		// same file might be listed in every checksum field
+		files := make(map[string]*Package)
+		names := make([]string, 0)
+		set := []struct {
+			tag string
+			fn  func(p *Package, sum string)
+		}{
+			{"Files", func(p *Package, sum string) { p.MD5 = sum }},
+			{"Checksums-Sha1", func(p *Package, sum string) { p.SHA1 = sum }},
+			{"Checksums-Sha256", func(p *Package, sum string) { p.SHA256 = sum }},
+			{"Checksums-Sha512", func(p *Package, sum string) { p.SHA512 = sum }},
+		}
+		for _, s := range set {
+			for _, f := range c[s.tag] {
+				data := strings.Fields(f)
+				if len(data) != 3 {
+					continue
+				}
+
+				sz, err := strconv.ParseInt(data[1], 10, 64)
+				if err != nil {
+					return err
+				}
+				pkg, ok := files[data[2]]
+				if !ok {
+					pkg = &Package{URL: repo.File(path.Join(dir, data[2])), Size: sz}
+					files[data[2]] = pkg
+					names = append(names, data[2])
+				}
+				s.fn(pkg, strings.ToLower(data[0]))
 			}
-			ret = append(ret, Package{u, sz, data[0]})
+		}
+
+		for _, name := range names {
+			ret = append(ret, *files[name])
 		}
 		return
 	}
@@ -47,8 +71,7 @@ func ParsePackage(repo Repository, r io.Reader) (ret []Package, err error) {
 		c := ParseControlFile(p)
 		f := strings.TrimSpace(c.Get("Filename"))
 		s := strings.TrimSpace(c.Get("Size"))
-		m := strings.TrimSpace(c.Get("MD5sum"))
-		if f == "" || s == "" || m == "" {
+		if f == "" || s == "" {
 			return
 		}
 		u := repo.File(f)
@@ -56,7 +79,12 @@ func ParsePackage(repo Repository, r io.Reader) (ret []Package, err error) {
 		if err != nil {
 			return
 		}
-		ret = append(ret, Package{u, sz, m})
+		ret = append(ret, Package{u, sz, Checksums{
+			MD5:    strings.ToLower(strings.TrimSpace(c.Get("MD5sum"))),
+			SHA1:   strings.ToLower(strings.TrimSpace(c.Get("SHA1"))),
+			SHA256: strings.ToLower(strings.TrimSpace(c.Get("SHA256"))),
+			SHA512: strings.ToLower(strings.TrimSpace(c.Get("SHA512"))),
+		}})
 		return
 	}
 
@@ -68,6 +96,7 @@ func ParsePackage(repo Repository, r io.Reader) (ret []Package, err error) {
 
 	// process line by line to save memory
 	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
 	pkgStr := ""
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -86,45 +115,73 @@ func ParsePackage(repo Repository, r io.Reader) (ret []Package, err error) {
 		pkgStr = ""
 	}
 
+	// corrupted or truncated file must not be taken as a shorter package list,
+	// or package files will be removed when cleaning
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
 	if pkgStr != "" {
 		err = do(pkgStr)
 	}
 	return
 }
 
-func (p Package) test(path string) bool {
+func (p Package) test(cfg *Config, path string) bool {
 	f, err := os.Stat(path)
 	if err != nil {
 		return false
 	}
 
-	if f.Size() != p.Size {
+	if p.Size >= 0 && f.Size() != p.Size {
 		return false
 	}
 
-	/* temporarily comment out md5 check, it's too slow
-	res, err := exec.Command("md5sum", path).Output()
-	if err != nil {
-		return false
+	algo, sum := p.Strongest()
+	if algo == "" {
+		return true
 	}
 
-	return string(res)[0:32] == p.MD5Sum
-	*/
-
-	return true
+	var actual string
+	switch cfg.Variables["verify_checksums"] {
+	case "size":
+		return true
+	case "full":
+		actual, err = HashFile(path, algo)
+	default:
+		actual, err = cfg.checksums.Sum(path, f, algo)
+	}
+	return err == nil && actual == sum
 }
 
 // Test tests if we have this Debian package on disk now.
+//
+// How we test it depends on verify_checksums variable: "size" checks only file
+// size, "full" also hashes the file, and "cached" (default) hashes only files
+// changed since last run.
 func (p Package) Test(cfg *Config) bool {
 	mirrorPath := cfg.MirrorPath(p.URL)
 	skelPath := cfg.SkelPath(p.URL)
 
-	return p.test(mirrorPath) || p.test(skelPath)
+	return p.test(cfg, mirrorPath) || p.test(cfg, skelPath)
 }
 
-// Download will download the Debian package into temporary (skel) directory
+// Download will download the Debian package into temporary (skel) directory,
+// and verify it with the strongest checksum we know. The file is placed in skel
+// directory only if verified.
 func (p Package) Download(cfg *Config, agent Downloader) error {
 	skelPath := cfg.SkelPath(p.URL)
-	_, err := agent.Download(p.URL, skelPath)
-	return err
+	verify := func(fn string) error {
+		return VerifyFile(fn, p.Size, p.Checksums)
+	}
+	if _, err := Fetch(agent, p.URL, skelPath, verify); err != nil {
+		return err
+	}
+
+	// file will be moved to mirror_path, we don't have to hash it again next time.
+	if fi, err := os.Stat(skelPath); err == nil {
+		if algo, sum := p.Strongest(); algo != "" {
+			cfg.checksums.Remember(cfg.MirrorPath(p.URL), fi, algo, sum)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPackages = `Package: foo
+Version: 1.0
+Filename: pool/main/f/foo/foo_1.0_amd64.deb
+Size: 1024
+MD5sum: 5d41402abc4b2a76b9719d911017c592
+SHA256: 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824
+
+Package: bar
+Version: 2.0
+Filename: pool/main/b/bar/bar_2.0_all.deb
+Size: 2048
+SHA256: 486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7
+
+Package: baz
+Version: 3.0
+`
+
+const testSources = `Package: foo
+Version: 1.0
+Directory: pool/main/f/foo
+Files:
+ 5d41402abc4b2a76b9719d911017c592 1024 foo_1.0.dsc
+ 7d793037a0760186574b0282f2f435e7 4096 foo_1.0.tar.gz
+Checksums-Sha256:
+ 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824 1024 foo_1.0.dsc
+ 486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7 4096 foo_1.0.tar.gz
+
+Package: bar
+Version: 2.0
+Directory: pool/main/b/bar
+Checksums-Sha256:
+ 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824 512 bar_2.0.dsc
+`
+
+func TestParsePackage(t *testing.T) {
+	repos, err := ParseRepo("deb http://ftp.tw.debian.org/debian stable main", "amd64")
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+
+	pkgs, err := ParsePackage(repos[0], strings.NewReader(testPackages))
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+	if len(pkgs) != 2 {
+		t.Fatalf("Expected 2 packages, got %d", len(pkgs))
+	}
+
+	if p := pkgs[0]; p.URL.Path != "/debian/pool/main/f/foo/foo_1.0_amd64.deb" || p.Size != 1024 ||
+		p.MD5 != "5d41402abc4b2a76b9719d911017c592" || p.SHA256 == "" {
+		t.Errorf("Unexpected package %s: %#v", p.URL, p)
+	}
+
+	// package without MD5sum
+	p := pkgs[1]
+	if p.URL.Path != "/debian/pool/main/b/bar/bar_2.0_all.deb" || p.Size != 2048 || p.MD5 != "" {
+		t.Errorf("Unexpected package %s: %#v", p.URL, p)
+	}
+	if algo, _ := p.Strongest(); algo != "SHA256" {
+		t.Errorf("Expected strongest hash of %s is SHA256, got %s", p.URL, algo)
+	}
+
+	// truncated file
+	data := xzString(testPackages)
+	r, err := decompressors[".xz"](strings.NewReader(data[:len(data)/2]))
+	if err != nil {
+		t.Fatalf("Cannot decompress: %s", err)
+	}
+	if pkgs, err := ParsePackage(repos[0], r); err == nil {
+		t.Errorf("Expected error parsing truncated file, got %d packages", len(pkgs))
+	}
+}
+
+func TestParseSources(t *testing.T) {
+	repos, err := ParseRepo("deb-src http://ftp.tw.debian.org/debian stable main", "amd64")
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+
+	pkgs, err := ParsePackage(repos[0], strings.NewReader(testSources))
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+
+	expect := map[string]int64{
+		"/debian/pool/main/f/foo/foo_1.0.dsc":    1024,
+		"/debian/pool/main/f/foo/foo_1.0.tar.gz": 4096,
+		"/debian/pool/main/b/bar/bar_2.0.dsc":    512,
+	}
+	if len(pkgs) != len(expect) {
+		t.Fatalf("Expected %d files, got %d", len(expect), len(pkgs))
+	}
+	for _, p := range pkgs {
+		sz, ok := expect[p.URL.Path]
+		if !ok {
+			t.Errorf("Unexpected file %s", p.URL)
+			continue
+		}
+		if p.Size != sz {
+			t.Errorf("Expected size of %s is %d, got %d", p.URL, sz, p.Size)
+		}
+		if p.SHA256 == "" {
+			t.Errorf("Expected sha256 of %s", p.URL)
+		}
+	}
+}
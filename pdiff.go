@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PDiffEntry is a line in Packages.diff/Index, denoting a version of Packages file or a patch.
+type PDiffEntry struct {
+	Name string
+	Size int64
+	Sum  string
+}
+
+// PDiffIndex represents a Packages.diff/Index file.
+type PDiffIndex struct {
+	// Algo is the hash algorithm used by all entries, SHA256 or SHA1.
+	Algo    string
+	Current PDiffEntry
+	// History lists previous versions of Packages file, and the patch updating it.
+	History []PDiffEntry
+	// Patches lists checksums of uncompressed patches.
+	Patches []PDiffEntry
+	// Download lists checksums of compressed patches, which might be empty in older format.
+	Download []PDiffEntry
+	// Merged reports whether every patch updates to current version directly.
+	Merged bool
+}
+
+func parsePDiffEntries(lines []string) (ret []PDiffEntry, err error) {
+	for _, l := range lines {
+		data := strings.Fields(l)
+		if len(data) == 0 {
+			continue
+		}
+		if len(data) != 3 {
+			return nil, fmt.Errorf("format error: %#v", l)
+		}
+		sz, err := strconv.ParseInt(data[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size of %s: %s", data[2], err)
+		}
+		ret = append(ret, PDiffEntry{data[2], sz, strings.ToLower(data[0])})
+	}
+	return
+}
+
+// ParsePDiffIndex parses Packages.diff/Index file. SHA256 checksums are used if
+// available, or SHA1.
+func ParsePDiffIndex(data string) (ret *PDiffIndex, err error) {
+	fields := ParseControlFile(data)
+	ret = &PDiffIndex{Merged: strings.TrimSpace(fields.Get("X-Patch-Precedence")) == "merged"}
+	for _, algo := range []string{"SHA256", "SHA1"} {
+		if _, ok := fields[algo+"-Current"]; ok {
+			ret.Algo = algo
+			break
+		}
+	}
+	if ret.Algo == "" {
+		return nil, fmt.Errorf("current version is not listed")
+	}
+
+	cur := strings.Fields(fields.Get(ret.Algo + "-Current"))
+	if len(cur) != 2 {
+		return nil, fmt.Errorf("format error of current version: %v", cur)
+	}
+	ret.Current.Sum = strings.ToLower(cur[0])
+	if ret.Current.Size, err = strconv.ParseInt(cur[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid size of current version: %s", err)
+	}
+
+	if ret.History, err = parsePDiffEntries(fields[ret.Algo+"-History"]); err != nil {
+		return
+	}
+	if ret.Patches, err = parsePDiffEntries(fields[ret.Algo+"-Patches"]); err != nil {
+		return
+	}
+	ret.Download, err = parsePDiffEntries(fields[ret.Algo+"-Download"])
+	return
+}
+
+// checksums returns Checksums holding hash value of e.
+func (p *PDiffIndex) checksums(e PDiffEntry) (ret Checksums) {
+	switch p.Algo {
+	case "SHA256":
+		ret.SHA256 = e.Sum
+	case "SHA1":
+		ret.SHA1 = e.Sum
+	}
+	return
+}
+
+// Files returns compressed patches to download, with their size and checksums.
+// Size is -1 if not known.
+func (p *PDiffIndex) Files() []*IndexFile {
+	if len(p.Download) > 0 {
+		ret := make([]*IndexFile, len(p.Download))
+		for i, e := range p.Download {
+			ret[i] = &IndexFile{e.Name, e.Size, p.checksums(e)}
+		}
+		return ret
+	}
+
+	// older format lists only uncompressed patches
+	ret := make([]*IndexFile, len(p.Patches))
+	for i, e := range p.Patches {
+		ret[i] = &IndexFile{Name: e.Name + ".gz", Size: -1}
+	}
+	return ret
+}
+
+// PatchesFrom returns name of patches to apply, in order, to update the version
+// whose hash is sum to current version. ok is false if the version is unknown.
+func (p *PDiffIndex) PatchesFrom(sum string) (ret []string, ok bool) {
+	if sum == p.Current.Sum {
+		return nil, true
+	}
+	for i, h := range p.History {
+		if h.Sum != sum {
+			continue
+		}
+		if p.Merged {
+			return []string{h.Name}, true
+		}
+		for _, h := range p.History[i:] {
+			ret = append(ret, h.Name)
+		}
+		return ret, true
+	}
+	return nil, false
+}
+
+// fetchPDiffs downloads patches listed in Packages.diff/Index at u. Patches never
+// change once published, so copies in mirror_path are reused.
+func (r Repository) fetchPDiffs(cfg *Config, dlMgr *DownloadManager, u *url.URL) error {
+	data, err := ioutil.ReadFile(cfg.SkelPath(u))
+	if err != nil {
+		return err
+	}
+	index, err := ParsePDiffIndex(string(data))
+	if err != nil {
+		return fmt.Errorf("cannot parse %s: %s", u, err)
+	}
+
+	for _, f := range index.Files() {
+		p := r.File(path.Join(path.Dir(u.Path), f.Name))
+		verify := func(fn string) error {
+			if f.Size < 0 {
+				return nil
+			}
+			return VerifyFile(fn, f.Size, f.Checksums)
+		}
+
+		mirror := cfg.MirrorPath(p)
+		if _, err := os.Stat(mirror); err == nil && verify(mirror) == nil {
+			if err = linkFile(mirror, cfg.SkelPath(p)); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err = Fetch(dlMgr.Dispatch(p), p, cfg.SkelPath(p), verify); err != nil {
+			return fmt.Errorf("cannot download patch %s: %s", p, err)
+		}
+		log.Printf("Patch %s downloaded", p)
+	}
+	return nil
+}
+
+var edRegexp *regexp.Regexp
+
+func init() {
+	var err error
+	if edRegexp, err = regexp.Compile(`^(\d+)(?:,(\d+))?([acd])$`); err != nil {
+		log.Fatalf("Cannot compile regexp for parsing ed script: %s", err)
+	}
+}
+
+type edCommand struct {
+	start, end int
+	op         byte
+	text       []string
+}
+
+// applyEdPatch applies patch generated by "diff --ed" to lines. Commands in such
+// patch are in descending order of line numbers.
+func applyEdPatch(lines []string, patch io.Reader) ([]string, error) {
+	var cmds []edCommand
+	scanner := bufio.NewScanner(patch)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		m := edRegexp.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			return nil, fmt.Errorf("unsupported ed command %#v", scanner.Text())
+		}
+		c := edCommand{op: m[3][0]}
+		c.start, _ = strconv.Atoi(m[1])
+		c.end = c.start
+		if m[2] != "" {
+			c.end, _ = strconv.Atoi(m[2])
+		}
+		if c.op != 'd' {
+			for {
+				if !scanner.Scan() {
+					return nil, fmt.Errorf("unterminated text of command %s", m[0])
+				}
+				if scanner.Text() == "." {
+					break
+				}
+				c.text = append(c.text, scanner.Text())
+			}
+		}
+		cmds = append(cmds, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// apply from the first line, so we copy each line only once
+	ret := make([]string, 0, len(lines))
+	pos := 0
+	for i := len(cmds) - 1; i >= 0; i-- {
+		c := cmds[i]
+		from := c.start - 1
+		if c.op == 'a' {
+			from = c.start
+		}
+		if from < pos || c.end < c.start || c.end > len(lines) {
+			return nil, fmt.Errorf("line number %d,%d out of order", c.start, c.end)
+		}
+		ret = append(ret, lines[pos:from]...)
+		ret = append(ret, c.text...)
+		pos = from
+		if c.op != 'a' {
+			pos = c.end
+		}
+	}
+	return append(ret, lines[pos:]...), nil
+}
+
+// compressPackages regenerates compressed variants of rebuilt Packages file of
+// component c, so they are not downloaded again. Variants not listed in Release,
+// or not identical to the listed one, are skipped. It returns urls of variants
+// regenerated.
+func (r Repository) compressPackages(cfg *Config, c string, release *Release, distsPath string) (ret []*url.URL) {
+	plain := r.Packages(c)
+	for _, u := range r.PackageFiles(c) {
+		ext := path.Ext(u.Path)
+		if _, ok := compressors[ext]; !ok || u.Path == plain.Path {
+			continue
+		}
+		name := strings.TrimPrefix(u.Path, distsPath)
+		listed, ok := release.Files[name]
+		if !ok {
+			continue
+		}
+		dst := cfg.SkelPath(u)
+		if err := compressFile(cfg.SkelPath(plain), dst, ext); err != nil {
+			log.Printf("Cannot compress %s: %s", dst, err)
+			continue
+		}
+		if err := VerifyFile(dst, listed.Size, listed.Checksums); err != nil {
+			os.Remove(dst)
+			continue
+		}
+		ret = append(ret, u)
+	}
+	return
+}
+
+// patchPackages rebuilds Packages file of component c in skel_path, by applying
+// patches in Packages.diff to the copy in mirror_path. Packages.diff/Index must
+// be downloaded already.
+func (r Repository) patchPackages(cfg *Config, c string, release *Release, distsPath string) error {
+	plain := r.Packages(c)
+	listed, ok := release.Files[strings.TrimPrefix(plain.Path, distsPath)]
+	if !ok {
+		return fmt.Errorf("%s is not listed in Release file", plain)
+	}
+	indexURL := r.File(plain.Path + ".diff/Index")
+	data, err := ioutil.ReadFile(cfg.SkelPath(indexURL))
+	if err != nil {
+		return err
+	}
+	index, err := ParsePDiffIndex(string(data))
+	if err != nil {
+		return err
+	}
+
+	// previous version in mirror, any variant is fine
+	var old []byte
+	for _, u := range r.PackageFiles(c) {
+		f, err := OpenIndex(cfg.MirrorPath(u))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		old, err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		break
+	}
+	if old == nil {
+		return fmt.Errorf("no previous version in mirror")
+	}
+	sum, err := hashReader(bytes.NewReader(old), index.Algo)
+	if err != nil {
+		return err
+	}
+	patches, ok := index.PatchesFrom(sum)
+	if !ok {
+		return fmt.Errorf("previous version is too old")
+	}
+
+	lines := strings.Split(string(old), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for _, p := range patches {
+		fn := cfg.SkelPath(r.File(plain.Path + ".diff/" + p + ".gz"))
+		f, err := OpenIndex(fn)
+		if err != nil {
+			return err
+		}
+		lines, err = applyEdPatch(lines, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("cannot apply patch %s: %s", fn, err)
+		}
+	}
+
+	dst := cfg.SkelPath(plain)
+	tmp := dst + partialSuffix
+	os.MkdirAll(path.Dir(dst), 0755)
+	if err = ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	if err = VerifyFile(tmp, listed.Size, listed.Checksums); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestApplyEdPatch(t *testing.T) {
+	lines := []string{"a", "b", "c", "d", "e"}
+	patch := "5a\nf\ng\n.\n3,4c\nC\n.\n1d\n0a\nz\n.\n"
+	actual, err := applyEdPatch(lines, strings.NewReader(patch))
+	if err != nil {
+		t.Fatalf("Cannot apply patch: %s", err)
+	}
+	expect := []string{"z", "b", "C", "e", "f", "g"}
+	if !reflect.DeepEqual(actual, expect) {
+		t.Errorf("Expected %v, got %v", expect, actual)
+	}
+
+	if _, err := applyEdPatch(lines, strings.NewReader("1d\n3d\n")); err == nil {
+		t.Errorf("Expected error applying commands in wrong order")
+	}
+	if _, err := applyEdPatch(lines, strings.NewReader("7d\n")); err == nil {
+		t.Errorf("Expected error deleting lines out of range")
+	}
+}
+
+func TestPatchesFrom(t *testing.T) {
+	index, err := ParsePDiffIndex(`SHA256-Current: cccc 30
+SHA256-History:
+ aaaa 10 T-1
+ bbbb 20 T-2
+SHA256-Patches:
+ 1111 5 T-1
+ 2222 5 T-2
+SHA256-Download:
+ 3333 6 T-1.gz
+ 4444 6 T-2.gz
+`)
+	if err != nil {
+		t.Fatalf("Cannot parse index: %s", err)
+	}
+	if len(index.Files()) != 2 || index.Files()[1].Name != "T-2.gz" || index.Files()[1].SHA256 != "4444" {
+		t.Errorf("Unexpected patches to download: %v", index.Files())
+	}
+
+	data := map[string][]string{
+		"aaaa": {"T-1", "T-2"},
+		"bbbb": {"T-2"},
+		"cccc": nil,
+	}
+	for sum, expect := range data {
+		actual, ok := index.PatchesFrom(sum)
+		if !ok || !reflect.DeepEqual(actual, expect) {
+			t.Errorf("Expected patches from %s are %v, got %v", sum, expect, actual)
+		}
+	}
+	if _, ok := index.PatchesFrom("dddd"); ok {
+		t.Errorf("Expected unknown version cannot be patched")
+	}
+
+	index.Merged = true
+	if actual, _ := index.PatchesFrom("aaaa"); !reflect.DeepEqual(actual, []string{"T-1"}) {
+		t.Errorf("Expected merged patch is applied alone, got %v", actual)
+	}
+}
+
+func TestPatchPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := "Package: foo\nFilename: pool/main/f/foo/foo_1.0_amd64.deb\nSize: 5\n"
+	cur := "Package: foo\nFilename: pool/main/f/foo/foo_1.1_amd64.deb\nSize: 5\n"
+	patch := gzipString("2c\nFilename: pool/main/f/foo/foo_1.1_amd64.deb\n.\n")
+	sum := func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }
+	index := fmt.Sprintf("SHA256-Current: %s %d\nSHA256-History:\n %s %d T-1\nSHA256-Patches:\n %s 0 T-1\nSHA256-Download:\n %s %d T-1.gz\n",
+		sum(cur), len(cur), sum(old), len(old), sum("unused"), sum(patch), len(patch))
+
+	archive := path.Join(dir, "archive")
+	writeTestArchive(t, archive, "stable", map[string]string{
+		"dists/stable/main/binary-amd64/Packages":            cur,
+		"dists/stable/main/binary-amd64/Packages.gz":         gzipString(cur),
+		"dists/stable/main/binary-amd64/Packages.xz":         xzString(cur),
+		"dists/stable/main/binary-amd64/Packages.diff/Index": index,
+	})
+	// Packages files are listed but not published, so they cannot be downloaded
+	for _, ext := range []string{"", ".gz", ".xz"} {
+		os.Remove(path.Join(archive, "dists/stable/main/binary-amd64/Packages"+ext))
+	}
+	ioutil.WriteFile(path.Join(archive, "dists/stable/main/binary-amd64/Packages.diff/T-1.gz"), []byte(patch), 0644)
+
+	cfg := testConfig(t, dir, "set use_pdiff 1\ndeb "+archive+" stable main")
+	repo := cfg.Repositories[0]
+	mirror := cfg.MirrorPath(repo.Packages("main"))
+	os.MkdirAll(path.Dir(mirror), 0755)
+	ioutil.WriteFile(mirror+".gz", []byte(gzipString(old)), 0644)
+
+	wg := &sync.WaitGroup{}
+	if _, err := repo.DownloadInfoFiles(cfg, testManager(), wg); err != nil {
+		t.Fatalf("Cannot download info files: %s", err)
+	}
+	wg.Wait()
+
+	if actual, _ := ioutil.ReadFile(cfg.SkelPath(repo.Packages("main"))); string(actual) != cur {
+		t.Errorf("Expected Packages is rebuilt, got %#v", string(actual))
+	}
+	if actual, _ := ioutil.ReadFile(cfg.SkelPath(repo.File("dists/stable/main/binary-amd64/Packages.diff/T-1.gz"))); string(actual) != patch {
+		t.Errorf("Expected patch is mirrored, got %#v", string(actual))
+	}
+	for _, u := range []*url.URL{repo.PackagesGZ("main"), repo.File("dists/stable/main/binary-amd64/Packages.xz")} {
+		f, err := OpenIndex(cfg.SkelPath(u))
+		if err != nil {
+			t.Errorf("Expected %s is regenerated from rebuilt Packages, got %s", u, err)
+			continue
+		}
+		if actual, _ := ioutil.ReadAll(f); string(actual) != cur {
+			t.Errorf("Expected %s is regenerated from rebuilt Packages, got %#v", u, string(actual))
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// IndexFile denotes a file listed in checksum sections of Release file.
+type IndexFile struct {
+	Name string
+	Size int64
+	Checksums
+}
+
+// Release represents a Debian Release file.
+type Release struct {
+	Fields url.Values
+	// Files maps file path (relative to dists/<suite>/) to its size and checksums.
+	Files map[string]*IndexFile
+}
+
+// ParseRelease parses Debian Release file, collecting files listed in
+// MD5Sum, SHA1, SHA256 and SHA512 sections.
+func ParseRelease(data string) (ret *Release, err error) {
+	ret = &Release{
+		ParseControlFile(data),
+		make(map[string]*IndexFile),
+	}
+
+	set := map[string]func(f *IndexFile, sum string){
+		"MD5Sum": func(f *IndexFile, sum string) { f.MD5 = sum },
+		"SHA1":   func(f *IndexFile, sum string) { f.SHA1 = sum },
+		"SHA256": func(f *IndexFile, sum string) { f.SHA256 = sum },
+		"SHA512": func(f *IndexFile, sum string) { f.SHA512 = sum },
+	}
+
+	for tag, fn := range set {
+		for _, line := range ret.Fields[tag] {
+			data := strings.Fields(line)
+			if len(data) != 3 {
+				continue
+			}
+			sz, err := strconv.ParseInt(data[1], 10, 64)
+			if err != nil {
+				return ret, fmt.Errorf("invalid size of %s in %s section: %s", data[2], tag, err)
+			}
+
+			f, ok := ret.Files[data[2]]
+			if !ok {
+				f = &IndexFile{Name: data[2], Size: sz}
+				ret.Files[data[2]] = f
+			}
+			if f.Size != sz {
+				return ret, fmt.Errorf("size of %s in %s section is %d, but %d in other section",
+					data[2], tag, sz, f.Size)
+			}
+			fn(f, strings.ToLower(data[0]))
+		}
+	}
+	return
+}
+
+// AcquireByHash reports whether index files should also be published in by-hash
+// directories.
+func (r *Release) AcquireByHash() bool {
+	return strings.TrimSpace(r.Fields.Get("Acquire-By-Hash")) == "yes"
+}
+
+// Verify checks if the file at path matches the record of name in this Release file.
+// name is file path relative to dists/<suite>/, and listed reports whether it is in
+// the Release file. Files not listed are never checked.
+func (r *Release) Verify(name, path string) (listed bool, err error) {
+	f, listed := r.Files[name]
+	if !listed {
+		return
+	}
+	err = VerifyFile(path, f.Size, f.Checksums)
+	return
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseRelease(t *testing.T) {
+	data, err := ioutil.ReadFile("SiteRelease.sample")
+	if err != nil {
+		t.Fatalf("Cannot read sample file from filesystem: %s", err)
+	}
+
+	rel, err := ParseRelease(string(data))
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+
+	if len(rel.Files) != 538 {
+		t.Errorf("Expected 538 files, got %d", len(rel.Files))
+	}
+
+	f, ok := rel.Files["main/binary-amd64/Packages.gz"]
+	if !ok {
+		t.Fatalf("Expected main/binary-amd64/Packages.gz in file list")
+	}
+	if f.Size != 9035431 {
+		t.Errorf("Expected size 9035431, got %d", f.Size)
+	}
+	if f.MD5 != "271dd1807c77b05d238f5d90b3532e0a" {
+		t.Errorf("Unexpected md5sum %s", f.MD5)
+	}
+	if f.SHA1 == "" || f.SHA256 == "" {
+		t.Errorf("Expected sha1 and sha256 of %s, got %#v", f.Name, f.Checksums)
+	}
+}
+
+func TestReleaseVerify(t *testing.T) {
+	rel, err := ParseRelease(`Suite: stable
+MD5Sum:
+ 5d41402abc4b2a76b9719d911017c592 5 main/binary-amd64/Packages
+SHA256:
+ 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824 5 main/binary-amd64/Packages
+`)
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "Packages")
+
+	data := map[string]bool{
+		"hello":  true,
+		"hellO":  false,
+		"hello!": false,
+	}
+	for content, expect := range data {
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatalf("Cannot write test file: %s", err)
+		}
+
+		listed, err := rel.Verify("main/binary-amd64/Packages", fn)
+		if !listed {
+			t.Errorf("Expected Packages is listed")
+		}
+		if (err == nil) != expect {
+			t.Errorf("Verifying %#v: expected %v, got error %v", content, expect, err)
+		}
+	}
+
+	if listed, err := rel.Verify("main/binary-amd64/Release", fn); listed || err != nil {
+		t.Errorf("Expected unlisted file not checked, got %v, %v", listed, err)
+	}
+}
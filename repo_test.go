@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -143,3 +147,400 @@ func TestRepoPackagesURL(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRepoOptions(t *testing.T) {
+	defaultArch := "amd64"
+	data := []string{
+		"deb [signed-by=/tmp/key.gpg] http://ftp.tw.debian.org/debian stable main",
+		"deb [ signed-by=/tmp/key.gpg ] http://ftp.tw.debian.org/debian stable main",
+		"deb [arch=amd64 signed-by=/tmp/key.gpg] http://ftp.tw.debian.org/debian stable main",
+	}
+
+	for _, str := range data {
+		repos, err := ParseRepo(str, defaultArch)
+		if err != nil {
+			t.Fatalf("Parse error when parsing [%s]: %s", str, err)
+		}
+		for _, repo := range repos {
+			if repo.URL.String() != "http://ftp.tw.debian.org/debian/" {
+				t.Errorf("URL mismatch in [%s]: %s", str, repo.URL)
+			}
+			if !reflect.DeepEqual(repo.Components, []string{"main"}) {
+				t.Errorf("Component mismatch in [%s]: %s", str, repo.Components)
+			}
+			if k := repo.Keyring(&Config{Variables: map[string]string{}}); k != "/tmp/key.gpg" {
+				t.Errorf("Keyring mismatch in [%s]: %s", str, k)
+			}
+		}
+	}
+
+	if _, err := ParseRepo("deb [signed-by=/tmp/key.gpg http://ftp.tw.debian.org/debian stable main", defaultArch); err == nil {
+		t.Errorf("Expected error parsing unterminated options")
+	}
+}
+
+func TestInfoFiles(t *testing.T) {
+	files := []string{
+		"Contents-amd64.gz",
+		"Contents-i386.gz",
+		"main/Contents-amd64.gz",
+		"main/Contents-udeb-amd64.xz",
+		"main/Contents-all.gz",
+		"main/Contents-source.gz",
+		"main/binary-amd64/Packages",
+		"main/binary-amd64/Packages.gz",
+		"main/binary-amd64/Packages.xz",
+		"main/binary-amd64/Release",
+		"main/binary-i386/Packages.xz",
+		"main/binary-all/Packages.xz",
+		"main/debian-installer/binary-amd64/Packages.xz",
+		"main/cnf/Commands-amd64.xz",
+		"main/dep11/Components-amd64.yml.gz",
+		"main/dep11/Components-i386.yml.gz",
+		"main/dep11/CID-Index-amd64.json.gz",
+		"main/dep11/icons-48x48.tar.gz",
+		"main/dep11/icons-64x64@2.tar.gz",
+		"main/dep11/icons-256x256.tar.gz",
+		"main/i18n/Index",
+		"main/i18n/Translation-en.bz2",
+		"main/i18n/Translation-de.bz2",
+		"main/source/Sources.xz",
+		"contrib/binary-amd64/Packages.xz",
+	}
+	rel := "MD5Sum:\n"
+	for _, f := range files {
+		rel += " d41d8cd98f00b204e9800998ecf8427e 0 " + f + "\n"
+	}
+	release, err := ParseRelease(rel)
+	if err != nil {
+		t.Fatalf("Cannot parse Release: %s", err)
+	}
+
+	// the second repository of "deb" line is the implicit one of architecture "all",
+	// which must not overlap the first one
+	data := []struct {
+		conf   string
+		idx    int
+		expect []string
+	}{
+		{"deb http://ftp.tw.debian.org/debian stable main", 0, []string{
+			"Contents-amd64.gz",
+			"main/Contents-amd64.gz",
+			"main/Contents-udeb-amd64.xz",
+			"main/binary-amd64/Packages",
+			"main/binary-amd64/Packages.gz",
+			"main/binary-amd64/Packages.xz",
+			"main/binary-amd64/Release",
+			"main/cnf/Commands-amd64.xz",
+			"main/debian-installer/binary-amd64/Packages.xz",
+			"main/dep11/CID-Index-amd64.json.gz",
+			"main/dep11/Components-amd64.yml.gz",
+		}},
+		{"deb http://ftp.tw.debian.org/debian stable main", 1, []string{
+			"main/Contents-all.gz",
+			"main/binary-all/Packages.xz",
+			"main/dep11/icons-48x48.tar.gz",
+			"main/dep11/icons-64x64@2.tar.gz",
+			"main/i18n/Index",
+			"main/i18n/Translation-en.bz2",
+		}},
+		{"deb-src http://ftp.tw.debian.org/debian stable main", 0, []string{
+			"main/Contents-source.gz",
+			"main/source/Sources.xz",
+		}},
+	}
+	for _, d := range data {
+		repos, err := ParseRepo(d.conf, "amd64")
+		if err != nil {
+			t.Fatalf("Cannot parse %s: %s", d.conf, err)
+		}
+		actual := []string{}
+		for _, u := range repos[d.idx].InfoFiles(&Config{Variables: map[string]string{"translations": "en", "dep11_icons": "48x48 64x64@2", "mirror_udeb": "1"}}, release) {
+			actual = append(actual, strings.TrimPrefix(u.Path, "/debian/dists/stable/"))
+		}
+		if !reflect.DeepEqual(actual, d.expect) {
+			t.Errorf("Info files of %s (%s) mismatch, expected %v, got %v", d.conf, repos[d.idx].Architecture, d.expect, actual)
+		}
+	}
+}
+
+func TestContentsFiles(t *testing.T) {
+	repos, _ := ParseRepo("deb http://ftp.tw.debian.org/debian stable main contrib", "amd64")
+	repo := repos[0]
+
+	rel := "MD5Sum:\n"
+	for _, f := range []string{
+		"main/Contents-amd64.gz",
+		"main/Contents-udeb-amd64.gz",
+		"contrib/Contents-udeb-nf-amd64.gz",
+		"contrib/Contents-i386.gz",
+		"main/Contents-all.gz",
+		"main/Contents-udeb-all.gz",
+		"Contents-amd64.gz",
+		"Contents-source.gz",
+	} {
+		rel += " d41d8cd98f00b204e9800998ecf8427e 0 " + f + "\n"
+	}
+	release, _ := ParseRelease(rel)
+	expect := []string{
+		"Contents-amd64.gz",
+		"contrib/Contents-udeb-nf-amd64.gz",
+		"main/Contents-amd64.gz",
+		"main/Contents-udeb-amd64.gz",
+	}
+	actual := []string{}
+	for _, u := range repo.InfoFiles(&Config{}, release) {
+		actual = append(actual, strings.TrimPrefix(u.Path, "/debian/dists/stable/"))
+	}
+	if !reflect.DeepEqual(actual, expect) {
+		t.Errorf("Expected Contents files %v, got %v", expect, actual)
+	}
+
+	// architecture independent ones belong to the implicit repository of "all"
+	expect = []string{
+		"main/Contents-all.gz",
+		"main/Contents-udeb-all.gz",
+	}
+	actual = []string{}
+	for _, u := range repos[1].InfoFiles(&Config{}, release) {
+		actual = append(actual, strings.TrimPrefix(u.Path, "/debian/dists/stable/"))
+	}
+	if !reflect.DeepEqual(actual, expect) {
+		t.Errorf("Expected Contents files of %s %v, got %v", repos[1].Architecture, expect, actual)
+	}
+
+	// not listed in Release file
+	release, _ = ParseRelease("MD5Sum:\n d41d8cd98f00b204e9800998ecf8427e 0 main/binary-amd64/Packages.gz\n")
+	files := repo.InfoFiles(&Config{}, release)
+	if len(files) != 2 || files[1].Path != "/debian/dists/stable/Contents-amd64.gz" {
+		t.Errorf("Expected top level Contents file is downloaded, got %v", files)
+	}
+	if files = repos[1].InfoFiles(&Config{}, release); len(files) != 0 {
+		t.Errorf("Expected no Contents file of %s is guessed, got %v", repos[1].Architecture, files)
+	}
+}
+
+func TestMislabeledIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := "Package: foo\nFilename: pool/main/f/foo/foo_1.0_amd64.deb\nSize: 5\n"
+	archive := path.Join(dir, "archive")
+	writeTestArchive(t, archive, "stable", map[string]string{
+		"dists/stable/main/binary-amd64/Packages":    plain,
+		"dists/stable/main/binary-amd64/Packages.gz": gzipString(plain),
+	})
+	// server gzips plain Packages on the fly, which differs from listed Packages.gz
+	ioutil.WriteFile(path.Join(archive, "dists/stable/main/binary-amd64/Packages"), []byte(storedGzipString(plain)), 0644)
+
+	cfg := testConfig(t, dir, "deb "+archive+" stable main")
+	repo := cfg.Repositories[0]
+	wg := &sync.WaitGroup{}
+	if _, err := repo.DownloadInfoFiles(cfg, testManager(), wg); err != nil {
+		t.Fatalf("Cannot download info files: %s", err)
+	}
+	wg.Wait()
+
+	// plain file sent for compressed one
+	u := repo.File("dists/stable/main/i18n/Translation-en.xz")
+	os.MkdirAll(path.Dir(cfg.SkelPath(u)), 0755)
+	ioutil.WriteFile(cfg.SkelPath(u), []byte(plain), 0644)
+	files, err := repo.normalize(cfg, u)
+	if err != nil || len(files) != 1 || path.Base(files[0].Path) != "Translation-en" {
+		t.Errorf("Expected %s is saved as plain file, got %v (%v)", u, files, err)
+	}
+
+	data := map[string]string{
+		"dists/stable/main/binary-amd64/Packages":    plain,
+		"dists/stable/main/binary-amd64/Packages.gz": gzipString(plain),
+		"dists/stable/main/i18n/Translation-en":      plain,
+	}
+	for fn, expect := range data {
+		actual, err := ioutil.ReadFile(cfg.SkelPath(repo.File(fn)))
+		if err != nil || string(actual) != expect {
+			t.Errorf("Expected content of %s is %#v, got %#v (%v)", fn, expect, string(actual), err)
+		}
+	}
+	if _, err := os.Stat(cfg.SkelPath(u)); err == nil {
+		t.Errorf("Expected mislabeled %s is renamed", u)
+	}
+
+	// plain file is fetched already
+	ioutil.WriteFile(cfg.SkelPath(u), []byte("other"), 0644)
+	if files, err := repo.normalize(cfg, u); err != nil || len(files) != 0 {
+		t.Errorf("Expected mislabeled %s is discarded, got %v (%v)", u, files, err)
+	}
+	if actual, _ := ioutil.ReadFile(cfg.SkelPath(repo.File("dists/stable/main/i18n/Translation-en"))); string(actual) != plain {
+		t.Errorf("Expected fetched plain file is not overwritten, got %#v", string(actual))
+	}
+	if _, err := os.Stat(cfg.SkelPath(u)); err == nil {
+		t.Errorf("Expected mislabeled %s is removed", u)
+	}
+}
+
+func TestSmallestIndexVariant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := strings.Repeat("Package: foo\nFilename: pool/main/f/foo/foo_1.0_amd64.deb\nSize: 5\n\n", 100)
+	archive := path.Join(dir, "archive")
+	writeTestArchive(t, archive, "stable", map[string]string{
+		"dists/stable/main/binary-amd64/Packages.xz":  xzString(plain),
+		"dists/stable/main/binary-amd64/Packages.zst": zstdString(plain),
+		"dists/stable/main/binary-amd64/Packages.gz":  storedGzipString(plain),
+	})
+	release, _ := ioutil.ReadFile(path.Join(archive, "dists/stable/Release"))
+	rel, _ := ParseRelease(string(release))
+
+	cfg := testConfig(t, dir, "deb "+archive+" stable main")
+	repo := cfg.Repositories[0]
+	smallest := ""
+	for _, ext := range []string{".xz", ".zst", ".gz"} {
+		name := "main/binary-amd64/Packages" + ext
+		if smallest == "" || rel.Files[name].Size < rel.Files[smallest].Size {
+			smallest = name
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	indices, err := repo.DownloadInfoFiles(cfg, testManager(), wg)
+	if err != nil {
+		t.Fatalf("Cannot download info files: %s", err)
+	}
+	if expect := repo.File("dists/stable/" + smallest); len(indices) != 1 || indices[0].Path != expect.Path {
+		t.Errorf("Expected smallest variant %s is downloaded in foreground and parsed, got %v", expect, indices)
+	}
+	wg.Wait()
+
+	for _, u := range repo.PackageFiles("main") {
+		f, err := OpenIndex(cfg.SkelPath(u))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Cannot open %s: %s", u, err)
+		}
+		pkgs, err := ParsePackage(repo, f)
+		f.Close()
+		if err != nil || len(pkgs) != 100 {
+			t.Errorf("Expected 100 packages in %s, got %d (%v)", u, len(pkgs), err)
+		}
+	}
+	for _, ext := range []string{".xz", ".zst"} {
+		if _, err := os.Stat(cfg.SkelPath(repo.File("dists/stable/main/binary-amd64/Packages" + ext))); err != nil {
+			t.Errorf("Expected all advertised variants are mirrored: %s", err)
+		}
+	}
+}
+
+func TestUdebIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "archive")
+	writeTestArchive(t, archive, "stable", map[string]string{
+		"dists/stable/main/binary-amd64/Packages.gz": gzipString(
+			"Package: foo\nFilename: pool/main/f/foo/foo_1.0_amd64.deb\nSize: 5\n"),
+		"dists/stable/main/debian-installer/binary-amd64/Packages.gz": gzipString(
+			"Package: foo-udeb\nFilename: pool/main/f/foo/foo-udeb_1.0_amd64.udeb\nSize: 5\n"),
+	})
+
+	data := []struct {
+		line string
+		udeb bool
+	}{
+		{"deb " + archive + " stable main", false},
+		{"deb [di=yes] " + archive + " stable main", true},
+		{"deb-src [di=yes] " + archive + " stable main", false},
+	}
+	for _, d := range data {
+		cfg := testConfig(t, dir, d.line)
+		repo := cfg.Repositories[0]
+		if repo.Udeb(cfg) != d.udeb {
+			t.Errorf("Expected udeb of %#v is %t", d.line, d.udeb)
+			continue
+		}
+		if repo.Architecture == "src" {
+			continue
+		}
+
+		os.RemoveAll(cfg.Variables["skel_path"])
+		wg := &sync.WaitGroup{}
+		if _, err := repo.DownloadInfoFiles(cfg, testManager(), wg); err != nil {
+			t.Fatalf("Cannot download info files of %#v: %s", d.line, err)
+		}
+		wg.Wait()
+
+		u := repo.File("dists/stable/main/debian-installer/binary-amd64/Packages.gz")
+		_, err := os.Stat(cfg.SkelPath(u))
+		if d.udeb && err != nil {
+			t.Errorf("Expected %s is downloaded with %#v: %s", u, d.line, err)
+		}
+		if !d.udeb && err == nil {
+			t.Errorf("Expected %s is not downloaded with %#v", u, d.line)
+		}
+	}
+
+	cfg := testConfig(t, dir, "set mirror_udeb 1\ndeb "+archive+" stable main")
+	if !cfg.Repositories[0].Udeb(cfg) {
+		t.Errorf("Expected mirror_udeb enables udeb of every repository")
+	}
+	cfg = testConfig(t, dir, "set mirror_udeb 1\ndeb [di=no] "+archive+" stable main")
+	if cfg.Repositories[0].Udeb(cfg) {
+		t.Errorf("Expected di=no disables udeb")
+	}
+}
+
+func TestIndexVariantFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := strings.Repeat("Package: foo\nFilename: pool/main/f/foo/foo_1.0_amd64.deb\nSize: 5\n\n", 100)
+	archive := path.Join(dir, "archive")
+	pkgs := path.Join(archive, "dists/stable/main/binary-amd64/Packages")
+	data := []struct {
+		desc   string
+		broken func()
+		expect string
+	}{
+		{"missing smallest variant", func() { os.Remove(pkgs + ".xz") }, ".gz"},
+		{"corrupted smallest variant", func() { ioutil.WriteFile(pkgs+".xz", []byte("broken"), 0644) }, ".gz"},
+		{"every variant missing", func() { os.Remove(pkgs + ".xz"); os.Remove(pkgs + ".gz") }, ""},
+	}
+	for _, d := range data {
+		os.RemoveAll(dir + "/skel")
+		os.RemoveAll(archive)
+		writeTestArchive(t, archive, "stable", map[string]string{
+			"dists/stable/main/binary-amd64/Packages.xz": xzString(plain),
+			"dists/stable/main/binary-amd64/Packages.gz": storedGzipString(plain),
+		})
+		d.broken()
+
+		cfg := testConfig(t, dir, "deb "+archive+" stable main")
+		repo := cfg.Repositories[0]
+		wg := &sync.WaitGroup{}
+		indices, err := repo.DownloadInfoFiles(cfg, testManager(), wg)
+		wg.Wait()
+		if d.expect == "" {
+			if err == nil {
+				t.Errorf("Expected suite is refused with %s, got %v", d.desc, indices)
+			}
+			continue
+		}
+		if err != nil || len(indices) != 1 || path.Ext(indices[0].Path) != d.expect {
+			t.Errorf("Expected %s variant is used with %s, got %v (%v)", d.expect, d.desc, indices, err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// writeStateFile replaces state file fn in var_path with content written by write.
+// Content is written into a temporary file first, so fn is never left half written.
+func writeStateFile(fn string, write func(w io.Writer)) error {
+	if err := os.MkdirAll(path.Dir(fn), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(path.Dir(fn), path.Base(fn))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	write(w)
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Validator identifies a version of remote file, used to send conditional requests.
+type Validator struct {
+	ETag         string
+	LastModified string
+}
+
+type validatorEntry struct {
+	size  int64
+	mtime int64
+	Validator
+}
+
+// ValidatorCache remembers ETag and Last-Modified of downloaded files, keyed by the
+// path of their copy in mirror. A validator is valid only if size and modification
+// time of the copy are not changed, so we never reuse a file not matching it.
+//
+// A nil *ValidatorCache is valid, which remembers nothing.
+type ValidatorCache struct {
+	lock    sync.Mutex
+	entries map[string]validatorEntry
+}
+
+// LoadValidatorCache reads cached validators from file. An empty cache is returned
+// if the file does not exist.
+func LoadValidatorCache(fn string) (*ValidatorCache, error) {
+	ret := &ValidatorCache{entries: make(map[string]validatorEntry)}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// each line is "path size mtime etag last-modified", tab separated
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		data := strings.Split(scanner.Text(), "\t")
+		if len(data) != 5 {
+			return nil, fmt.Errorf("format error at line#%d of %s", lineno, fn)
+		}
+		var e validatorEntry
+		var err1, err2 error
+		e.size, err1 = strconv.ParseInt(data[1], 10, 64)
+		e.mtime, err2 = strconv.ParseInt(data[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("format error at line#%d of %s", lineno, fn)
+		}
+		e.ETag, e.LastModified = data[3], data[4]
+		ret.entries[data[0]] = e
+	}
+	return ret, scanner.Err()
+}
+
+// Save writes cached validators into file. Records of files no longer exist are dropped.
+func (c *ValidatorCache) Save(fn string) error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return writeStateFile(fn, func(w io.Writer) {
+		for p, e := range c.entries {
+			if _, err := os.Lstat(p); err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", p, e.size, e.mtime, e.ETag, e.LastModified)
+		}
+	})
+}
+
+// Get returns validator of the file at p, ok is false if the file does not exist or
+// it is changed since the validator is remembered.
+func (c *ValidatorCache) Get(p string) (v Validator, ok bool) {
+	if c == nil {
+		return
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return
+	}
+
+	c.lock.Lock()
+	e, found := c.entries[p]
+	c.lock.Unlock()
+	if !found || e.size != fi.Size() || e.mtime != fi.ModTime().UnixNano() {
+		return
+	}
+	return e.Validator, true
+}
+
+// Remember records validator in resp for the file at p, fi is the result of os.Stat
+// on the downloaded file, which will be published at p.
+func (c *ValidatorCache) Remember(p string, fi os.FileInfo, resp *http.Response) {
+	if c == nil {
+		return
+	}
+	v := Validator{resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if v.ETag == "" && v.LastModified == "" {
+		delete(c.entries, p)
+		return
+	}
+	c.entries[p] = validatorEntry{fi.Size(), fi.ModTime().UnixNano(), v}
+}
+
+// Forget removes validator of the file at p.
+func (c *ValidatorCache) Forget(p string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, p)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func TestConditionalInfoFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt-mirror-go")
+	if err != nil {
+		t.Fatalf("Cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "archive")
+	files := map[string]string{
+		"dists/stable/main/binary-amd64/Packages.gz": gzipString("Package: foo\nFilename: pool/main/f/foo/foo_1.0_amd64.deb\nSize: 5\n"),
+	}
+	writeTestArchive(t, archive, "stable", files)
+
+	// status code of last request of each file
+	var lock sync.Mutex
+	status := make(map[string]int)
+	fs := http.FileServer(http.Dir(archive))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if data, err := ioutil.ReadFile(path.Join(archive, r.URL.Path)); err == nil {
+			w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+		}
+		rec := &statusRecorder{w, http.StatusOK}
+		fs.ServeHTTP(rec, r)
+		lock.Lock()
+		status[r.URL.Path] = rec.status
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	cfg := testConfig(t, dir, "deb "+server.URL+" stable main")
+	repo := cfg.Repositories[0]
+	validatorFile := path.Join(dir, "var", "validators")
+	run := func() {
+		if cfg.validators, err = LoadValidatorCache(validatorFile); err != nil {
+			t.Fatalf("Cannot load validators: %s", err)
+		}
+		wg := &sync.WaitGroup{}
+		if _, err := repo.DownloadInfoFiles(cfg, testManager(), wg); err != nil {
+			t.Fatalf("Cannot download info files: %s", err)
+		}
+		wg.Wait()
+		movefiles(cfg.Variables["skel_path"], cfg.Variables["mirror_path"])
+		if err := cfg.validators.Save(validatorFile); err != nil {
+			t.Fatalf("Cannot save validators: %s", err)
+		}
+	}
+	expect := func(fn string, code int) {
+		if status[fn] != code {
+			t.Errorf("Expected status of %s is %d, got %d", fn, code, status[fn])
+		}
+	}
+	pkgs := "/dists/stable/main/binary-amd64/Packages.gz"
+
+	run()
+	expect("/dists/stable/Release", http.StatusOK)
+	expect(pkgs, http.StatusOK)
+
+	run()
+	expect("/dists/stable/Release", http.StatusNotModified)
+	expect(pkgs, http.StatusNotModified)
+	if data, _ := ioutil.ReadFile(cfg.MirrorPath(repo.PackagesGZ("main"))); string(data) != files["dists/stable/main/binary-amd64/Packages.gz"] {
+		t.Errorf("Expected reused Packages.gz is published, got %#v", string(data))
+	}
+
+	// modified upstream
+	files["dists/stable/main/binary-amd64/Packages.gz"] = gzipString("Package: bar\nFilename: pool/main/b/bar/bar_1.0_amd64.deb\nSize: 5\n")
+	writeTestArchive(t, archive, "stable", files)
+	run()
+	expect("/dists/stable/Release", http.StatusOK)
+	expect(pkgs, http.StatusOK)
+
+	// copy in mirror is changed
+	ioutil.WriteFile(cfg.MirrorPath(repo.PackagesGZ("main")), []byte("broken"), 0644)
+	run()
+	expect("/dists/stable/Release", http.StatusNotModified)
+	expect(pkgs, http.StatusOK)
+}